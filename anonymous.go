@@ -0,0 +1,82 @@
+package ftpd
+
+import (
+	"log"
+	pathpkg "path"
+	"strings"
+)
+
+// AnonymousOpt 是匿名FTP的配置, 匿名用户以 anonymous 或 ftp 登录, 密码为电子邮件地址
+type AnonymousOpt struct {
+	// 匿名用户的根目录
+	Root string
+	// 匿名用户使用的文件系统, 为nil时使用以Root为根目录的本地文件系统, 两者不能都为空
+	FileSystem FileSystem
+	// 匿名用户的权限, 为0时只读(PermReadOnly)
+	Permissions Permission
+	// 只允许上传的目录(FTP路径), 匿名用户可以在其中上传新文件, 但不能列出、下载或覆盖. 为空时不允许上传
+	IncomingDir string
+	// 同时在线的匿名会话数上限, 0表示不限制
+	MaxSessions int
+}
+
+// 匿名登录使用的用户名
+func isAnonymousUser(username string) bool {
+	return strings.EqualFold(username, "anonymous") || strings.EqualFold(username, "ftp")
+}
+
+// 匿名用户的密码需要是电子邮件地址, 只做简单的格式检查
+func isEmailPassword(password string) bool {
+	return strings.Contains(password, "@") && !strings.ContainsAny(password, " \t")
+}
+
+func (opt *AnonymousOpt) newUser(username string) *FtpUser {
+	perm := opt.Permissions
+	if perm == 0 {
+		perm = PermReadOnly
+	}
+
+	user := &FtpUser{
+		Username:       username,
+		HomeDir:        opt.Root,
+		FileSystem:     opt.FileSystem,
+		Permissions:    perm,
+		PermissionsSet: true,
+		Anonymous:      true,
+	}
+	if opt.IncomingDir != "" {
+		user.PathPermissions = map[string]Permission{
+			pathpkg.Clean("/" + opt.IncomingDir): PermWrite,
+		}
+	}
+	return user
+}
+
+// 匿名登录, 超出匿名会话数上限时返回false
+func (session *FtpSession) loginAnonymous(username, password string) bool {
+	s := session.FtpServer
+	opt := s.opt.Anonymous
+
+	if !isEmailPassword(password) {
+		session.write(reply530NotLoggedIn, "Please use your email address as password.")
+		return false
+	}
+
+	s.mutex.Lock()
+	if opt.MaxSessions > 0 && s.anonymousSessions >= opt.MaxSessions {
+		s.mutex.Unlock()
+		session.write(reply530NotLoggedIn, "Too many anonymous users, try again later.")
+		return false
+	}
+	s.anonymousSessions++
+	s.mutex.Unlock()
+
+	log.Printf("[%s] Anonymous login, Password: %s", session.RemoteAddr, password)
+
+	session.mutex.Lock()
+	session.IsLoginedIn = true
+	session.FtpUser = opt.newUser(username)
+	session.mutex.Unlock()
+	session.write(reply230UserLoggedIn, "Anonymous access granted, restrictions apply.")
+	return true
+}
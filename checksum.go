@@ -0,0 +1,79 @@
+package ftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+var (
+	// HASH 命令支持的算法, 未通过 OPTS HASH 选择时使用 SHA-256
+	hashAlgorithms = []hashAlgorithm{
+		{"SHA-1", sha1.New},
+		{"SHA-256", sha256.New},
+		{"SHA-512", sha512.New},
+		{"MD5", md5.New},
+		{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+	}
+	defaultHashAlgorithm = "SHA-256"
+)
+
+type hashAlgorithm struct {
+	name string
+	new  func() hash.Hash
+}
+
+func findHashAlgorithm(name string) *hashAlgorithm {
+	for i := range hashAlgorithms {
+		if strings.EqualFold(hashAlgorithms[i].name, name) {
+			return &hashAlgorithms[i]
+		}
+	}
+	return nil
+}
+
+// FEAT 中 HASH 的描述, 当前选中的算法以 '*' 标记
+func hashFeature(selected string) string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for _, algo := range hashAlgorithms {
+		if algo.name == selected {
+			names = append(names, algo.name+"*")
+		} else {
+			names = append(names, algo.name)
+		}
+	}
+	return "HASH " + strings.Join(names, ";")
+}
+
+// 流式计算文件从start开始length个字节的摘要, length小于0时计算到文件末尾,
+// 返回十六进制摘要和实际计算的字节数
+func hashFile(fs FileSystem, path string, algo *hashAlgorithm, start, length int64) (string, int64, error) {
+	r, err := fs.Open(path, start)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	h := algo.new()
+	var n int64
+	if length < 0 {
+		n, err = io.Copy(h, r)
+	} else {
+		n, err = io.CopyN(h, r, length)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
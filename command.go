@@ -1,96 +1,174 @@
 package ftpd
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
-	"path/filepath"
+	pathpkg "path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-type commander interface {
+// Command 是FTP命令的处理器, 通过 FtpServer.RegisterCommand 注册
+type Command interface {
 	Execute(*FtpSession, *FtpRequest)
 }
 
-var (
-	// 无需用户权限的命令
-	nonAuthenticatedCommands = [6]string{"USER", "PASS", "AUTH", "QUIT", "PROT", "PBSZ"}
-
-	commands = map[string]commander{
-		"ABOR": abor{},
-		"ACCT": acct{},
-		"APPE": appe{},
-		"AUTH": auth{},
-		"CDUP": cdup{},
-		"CWD":  cwd{},
-		"DELE": dele{},
-		"EPRT": eprt{},
-		"EPSV": epsv{},
-		"FEAT": feat{},
-		"HELP": help{},
-		"LANG": lang{},
-		"LIST": list{},
-		"MD5":  md5{},
-		"MFMT": mfmt{},
-		"MMD5": md5{},
-		"MDTM": mdtm{},
-		"MLST": mlst{},
-		"MKD":  mkd{},
-		"MLSD": mlsd{},
-		"MODE": mode{},
-		"NLST": nlst{},
-		"NOOP": noop{},
-		"OPTS": opts{},
-		"PASS": pass{},
-		//"PASV":          pasv{},
-		"PBSZ": pbsz{},
-		"PORT": port{},
-		"PROT": prot{},
-		"PWD":  pwd{},
-		"QUIT": quit{},
-		"REIN": rein{},
-		"REST": rest{},
-		"RETR": retr{},
-		"RMD":  rmd{},
-		"RNFR": rnfr{},
-		"RNTO": rnto{},
-		//"SITE":          site{},
-		"SIZE":          size{},
-		"SITE_DESCUSER": siteDescuser{},
-		"SITE_HELP":     siteHelp{},
-		"SITE_STAT":     siteStat{},
-		"SITE_WHO":      siteWho{},
-		"SITE_ZONE":     siteZone{},
-		"STAT":          stat{},
-		"STOR":          stor{},
-		"STOU":          stou{},
-		"STRU":          stru{},
-		"SYST":          syst{},
-		"TYPE":          typeCommand{},
-		"USER":          user{},
-		"XPWD":          pwd{},
-		"XMKD":          mkd{},
-		"XRMD":          rmd{},
-	}
-
-	optsMap = map[string]commander{
-		"OPTS_MLST": optsMlst{},
-		"OPTS_UTF8": optsUTF8{},
+// CommandFunc 将普通函数适配为 Command
+type CommandFunc func(*FtpSession, *FtpRequest)
+
+func (f CommandFunc) Execute(session *FtpSession, request *FtpRequest) {
+	f(session, request)
+}
+
+// Command 可选实现的接口, FEAT 和 HELP 的内容都从命令表中生成
+type (
+	// Featurer 返回该命令在 FEAT 中声明的扩展功能, 为空时不声明
+	Featurer interface {
+		Feature(*FtpSession) string
+	}
+	// Helper 返回该命令的用法说明, 不包含命令名
+	Helper interface {
+		Help() string
+	}
+	// Enabler 决定命令是否对当前服务器和用户可用, 未实现时总是可用
+	Enabler interface {
+		Enabled(*FtpSession) bool
+	}
+	// AuthRequirer 决定命令是否需要登录后才能执行, 未实现时需要登录
+	AuthRequirer interface {
+		RequireAuth() bool
 	}
 )
 
-// 判断某个命令是否无需认证权限
-func isWithoutAuthenticationCommand(command string) bool {
-	for _, cmd := range nonAuthenticatedCommands {
-		if cmd == command {
-			return true
+// 内置命令, 每个 FtpServer 创建时复制一份.
+// OPTS 和 SITE 的子命令分别以 OPTS_<NAME>、SITE_<NAME> 为名注册
+var defaultCommands = map[string]Command{
+	"ABOR":          abor{},
+	"ACCT":          acct{},
+	"APPE":          appe{},
+	"AUTH":          auth{},
+	"CDUP":          cdup{},
+	"CWD":           cwd{},
+	"DELE":          dele{},
+	"EPRT":          eprt{},
+	"EPSV":          epsv{},
+	"FEAT":          feat{},
+	"HASH":          hashCommand{},
+	"HELP":          help{},
+	"LANG":          lang{},
+	"LIST":          list{},
+	"MD5":           md5Command{},
+	"MFMT":          mfmt{},
+	"MMD5":          mmd5{},
+	"MDTM":          mdtm{},
+	"MLST":          mlst{},
+	"MKD":           mkd{},
+	"MLSD":          mlsd{},
+	"MODE":          mode{},
+	"NLST":          nlst{},
+	"NOOP":          noop{},
+	"OPTS":          opts{},
+	"PASS":          pass{},
+	"PASV":          pasv{},
+	"PBSZ":          pbsz{},
+	"PORT":          port{},
+	"PROT":          prot{},
+	"PWD":           pwd{},
+	"QUIT":          quit{},
+	"RANG":          rang{},
+	"REIN":          rein{},
+	"REST":          rest{},
+	"RETR":          retr{},
+	"RMD":           rmd{},
+	"RNFR":          rnfr{},
+	"RNTO":          rnto{},
+	"SITE":          site{},
+	"SIZE":          size{},
+	"SITE_DESCUSER": siteDescuser{},
+	"SITE_HELP":     siteHelp{},
+	"SITE_QUOTA":    siteQuota{},
+	"SITE_STAT":     siteStat{},
+	"SITE_WHO":      siteWho{},
+	"SITE_ZONE":     siteZone{},
+	"STAT":          stat{},
+	"STOR":          stor{},
+	"STOU":          stou{},
+	"STRU":          stru{},
+	"SYST":          syst{},
+	"TYPE":          typeCommand{},
+	"USER":          user{},
+	"XCRC":          xhash{"CRC32"},
+	"XMD5":          xhash{"MD5"},
+	"XPWD":          pwd{},
+	"XMKD":          mkd{},
+	"XRMD":          rmd{},
+	"XSHA1":         xhash{"SHA-1"},
+	"XSHA256":       xhash{"SHA-256"},
+	"XSHA512":       xhash{"SHA-512"},
+	"OPTS_HASH":     optsHash{},
+	"OPTS_MLST":     optsMlst{},
+	"OPTS_UTF8":     optsUTF8{},
+}
+
+// 查找当前会话可用的命令, 不存在或未启用时返回nil
+func lookupCommand(session *FtpSession, name string) Command {
+	c := session.FtpServer.LookupCommand(name)
+	if c == nil || !commandEnabled(session, c) {
+		return nil
+	}
+	return c
+}
+
+func commandEnabled(session *FtpSession, c Command) bool {
+	if e, ok := c.(Enabler); ok {
+		return e.Enabled(session)
+	}
+	return true
+}
+
+func commandRequireAuth(c Command) bool {
+	if a, ok := c.(AuthRequirer); ok {
+		return a.RequireAuth()
+	}
+	return true
+}
+
+// 当前会话可用的命令名, 按字母排序, 不包含 OPTS 和 SITE 的子命令
+func commandNames(session *FtpSession) []string {
+	var names []string
+	for name, c := range session.FtpServer.registeredCommands() {
+		if strings.Contains(name, "_") || !commandEnabled(session, c) {
+			continue
 		}
+		names = append(names, name)
 	}
-	return false
+	sort.Strings(names)
+	return names
+}
+
+// 收集可用命令(包括子命令)声明的扩展功能, 去重后按字母排序
+func commandFeatures(session *FtpSession) []string {
+	seen := make(map[string]bool)
+	var lines []string
+	for _, c := range session.FtpServer.registeredCommands() {
+		f, ok := c.(Featurer)
+		if !ok || !commandEnabled(session, c) {
+			continue
+		}
+		if feature := f.Feature(session); feature != "" && !seen[feature] {
+			seen[feature] = true
+			lines = append(lines, feature)
+		}
+	}
+	sort.Strings(lines)
+	return lines
 }
 
 type abor struct{}
@@ -100,99 +178,377 @@ func (cmd abor) Execute(session *FtpSession, request *FtpRequest) {
 	session.write(reply226ClosingDataConnection, "ABOR command successful.")
 }
 
+func (cmd abor) Help() string {
+	return "(abort previous command and data transfer)"
+}
+
 type acct struct{}
 
 func (cmd acct) Execute(session *FtpSession, request *FtpRequest) {
 	session.write(reply202CommandNotImplemented, "Command ACCT not implemented, superfluous at this site.")
 }
 
+func (cmd acct) Help() string {
+	return "<account> (superfluous at this site)"
+}
+
 type appe struct{}
 
 func (cmd appe) Execute(session *FtpSession, request *FtpRequest) {
+	session.takeRange()
+
+	if request.Argument == "" {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	// 检查数据通道是否打开
+	if session.DataConn == nil {
+		session.write(reply503BadSequenceOfCommands, "PORT or PASV must be issued first.")
+		return
+	}
 
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermAppend, path) {
+		return
+	}
+
+	old, err := session.fileSystem().Stat(path)
+	if err != nil {
+		old = nil
+	}
+	file, err := session.createUpload(path, 0, os.O_APPEND, old)
+	if err == errQuotaExceeded {
+		session.write(reply552RequestedFileActionAbortedExceededStorage, "Exceeded storage allocation.")
+		return
+	}
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "Can't open file for append.")
+		return
+	}
+
+	session.write(reply150FileStatusOkay, "Data transfer starting.")
+	session.readFile(file, "")
+}
+
+func (cmd appe) Help() string {
+	return "<pathname> (append data to file)"
 }
 
 type auth struct{}
 
 func (cmd auth) Execute(session *FtpSession, request *FtpRequest) {
+	config := session.FtpServer.opt.TLSConfig
+	if config == nil {
+		session.write(reply502CommandNotImplemented, "Command AUTH not implemented, TLS is not configured.")
+		return
+	}
+
+	switch strings.ToUpper(request.Argument) {
+	case "TLS", "TLS-C", "SSL":
+	default:
+		session.write(reply504CommandNotImplementedForThatParameter, fmt.Sprintf("Command AUTH not implemented for the parameter %s.", request.Argument))
+		return
+	}
+
+	if session.isSecure() {
+		session.write(reply503BadSequenceOfCommands, "Already using TLS.")
+		return
+	}
 
+	session.write(reply234SecurityDataExchangeComplete, "AUTH command okay, starting TLS connection.")
+
+	if err := session.upgradeTLS(config); err != nil {
+		log.Printf("[%s] TLS handshake failed: %s", session.RemoteAddr, err)
+		session.Close()
+		return
+	}
+
+	log.Printf("[%s] Enable TLS on control connection", session.RemoteAddr)
+}
+
+func (cmd auth) Help() string {
+	return "TLS (upgrade control connection to TLS)"
+}
+
+func (cmd auth) RequireAuth() bool {
+	return false
+}
+
+func (cmd auth) Feature(session *FtpSession) string {
+	return "AUTH TLS"
+}
+
+func (cmd auth) Enabled(session *FtpSession) bool {
+	return session.FtpServer.opt.TLSConfig != nil
 }
 
 type cdup struct{}
 
 func (cmd cdup) Execute(session *FtpSession, request *FtpRequest) {
+	cwd{}.Execute(session, &FtpRequest{Line: request.Line, Command: "CWD", Argument: "..", ReceivedAt: request.ReceivedAt})
+}
 
+func (cmd cdup) Help() string {
+	return "(change to parent directory)"
 }
 
 type cwd struct{}
 
 func (cmd cwd) Execute(session *FtpSession, request *FtpRequest) {
 
-	path, info, err := session.buildPath(request.Argument)
-
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
 	if err != nil || !info.IsDir() {
 		session.write(reply550RequestedActionNotTaken, "No such directory.")
 		return
 	}
 
+	session.mutex.Lock()
 	session.CurrentDir = path
+	session.mutex.Unlock()
 	session.write(reply250RequestedFileActionOkay, fmt.Sprintf("\"%s\" is current directory.", path))
 }
 
+func (cmd cwd) Help() string {
+	return "<pathname> (change working directory)"
+}
+
 type dele struct{}
 
 func (cmd dele) Execute(session *FtpSession, request *FtpRequest) {
-	abspath, _ := session.getFilePath(request.Argument)
-	if fi, err := os.Stat(abspath); err != nil || fi.IsDir() {
+	fs := session.fileSystem()
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermDelete, path) {
+		return
+	}
+	fi, err := fs.Stat(path)
+	if err != nil || fi.IsDir() {
 		session.write(reply550RequestedActionNotTaken, "Not a valid file.")
 		return
 	}
-	if err := os.Remove(abspath); err != nil {
+	if err := fs.Remove(path); err != nil {
 		session.write(reply450RequestedFileActionNotTaken, "Can't delete file.")
 	} else {
+		if usage := session.quotaUsage(); usage != nil {
+			usage.release(fi.Size(), 1)
+		}
 		session.write(reply250RequestedFileActionOkay, "Requested file action okay, deleted "+request.Argument)
 	}
 }
 
+func (cmd dele) Help() string {
+	return "<pathname> (delete file)"
+}
+
 type eprt struct{}
 
 func (cmd eprt) Execute(session *FtpSession, request *FtpRequest) {
+	if session.getAttribute(attributeEpsvAll) != "" {
+		session.write(reply503BadSequenceOfCommands, "EPRT not allowed after EPSV ALL.")
+		return
+	}
 
+	addr, err := decoderExtendedSocket(request.Argument)
+	if err == ErrNetProtocol {
+		session.write(reply522NetworkProtocolNotSupported, "Network protocol not supported, use (1,2)")
+		return
+	}
+	if err != nil {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	if session.openPortConn(addr) {
+		session.write(reply200CommandOkay, "Command EPRT okay.")
+	}
+}
+
+func (cmd eprt) Help() string {
+	return "|<proto>|<address>|<port>| (open active data connection)"
+}
+
+func (cmd eprt) Feature(session *FtpSession) string {
+	return "EPRT"
 }
 
 type epsv struct{}
 
 func (cmd epsv) Execute(session *FtpSession, request *FtpRequest) {
+	argument := strings.ToUpper(request.Argument)
+
+	// EPSV ALL 之后只允许使用EPSV建立数据通道
+	if argument == "ALL" {
+		session.setAttribute(attributeEpsvAll, "true")
+		session.write(reply200CommandOkay, "EPSV ALL command successful.")
+		return
+	}
 
+	local, ok := session.LocalAddr.(*net.TCPAddr)
+	if !ok {
+		session.write(reply522NetworkProtocolNotSupported, "Network protocol not supported, use (1,2)")
+		return
+	}
+	protocol := netProtocol(local.IP)
+	if argument != "" && argument != protocol {
+		session.write(reply522NetworkProtocolNotSupported, fmt.Sprintf("Network protocol not supported, use (%s)", protocol))
+		return
+	}
+
+	conn := session.openPasvConn()
+	if conn == nil {
+		return
+	}
+
+	session.write(reply229EnteringExtendedPassiveMode, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", conn.Addr().Port))
+}
+
+func (cmd epsv) Help() string {
+	return "[<proto> | ALL] (enter extended passive mode)"
+}
+
+func (cmd epsv) Feature(session *FtpSession) string {
+	return "EPSV"
 }
 
 type feat struct{}
 
 func (cmd feat) Execute(session *FtpSession, request *FtpRequest) {
+	session.writeLines(reply211SystemStatusreply, "Features:", commandFeatures(session), "End")
+}
+
+func (cmd feat) Help() string {
+	return "(list supported features)"
+}
+
+func (cmd feat) RequireAuth() bool {
+	return false
+}
+
+type hashCommand struct{}
+
+func (cmd hashCommand) Execute(session *FtpSession, request *FtpRequest) {
+	start, end := session.takeRange()
+
+	if request.Argument == "" {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermRead, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "No such file or directory.")
+		return
+	}
+	if info.IsDir() {
+		session.write(reply550RequestedActionNotTaken, "Not a plain file.")
+		return
+	}
+	if start > info.Size() {
+		session.write(reply554RequestedActionNotTakenInvalidRest, "Invalid range.")
+		return
+	}
+
+	length := int64(-1)
+	if end >= 0 {
+		length = end - start + 1
+	}
+
+	algo := session.hashAlgorithm()
+	sum, n, err := hashFile(session.fileSystem(), path, algo, start, length)
+	if err != nil {
+		log.Print(err)
+		session.write(reply451RequestedActionAborted, "Error reading file.")
+		return
+	}
+
+	last := start + n - 1
+	if n == 0 {
+		last = start
+	}
+	session.write(reply213FileStatus, fmt.Sprintf("%s %d-%d %s %s", algo.name, start, last, sum, request.Argument))
+}
+
+func (cmd hashCommand) Help() string {
+	return "<pathname> (checksum of file, see OPTS HASH)"
+}
 
+func (cmd hashCommand) Feature(session *FtpSession) string {
+	return hashFeature(session.hashAlgorithm().name)
 }
 
 type help struct{}
 
 func (cmd help) Execute(session *FtpSession, request *FtpRequest) {
+	if request.Argument == "" {
+		// 每行列出8个命令
+		names := commandNames(session)
+		var lines []string
+		for i := 0; i < len(names); i += 8 {
+			end := i + 8
+			if end > len(names) {
+				end = len(names)
+			}
+			lines = append(lines, strings.Join(names[i:end], " "))
+		}
+		session.writeLines(reply214HelpMessage, "The following commands are recognized.", lines, "Help OK.")
+		return
+	}
 
+	name := strings.ToUpper(request.Argument)
+	c := lookupCommand(session, name)
+	if c == nil || strings.Contains(name, "_") {
+		session.write(reply502CommandNotImplemented, "Unknown command "+request.Argument+".")
+		return
+	}
+	if h, ok := c.(Helper); ok {
+		session.write(reply214HelpMessage, "Syntax: "+name+" "+h.Help())
+		return
+	}
+	session.write(reply214HelpMessage, "Syntax: "+name)
+}
+
+func (cmd help) Help() string {
+	return "[<command>] (show help)"
+}
+
+func (cmd help) RequireAuth() bool {
+	return false
 }
 
 type lang struct{}
 
 func (cmd lang) Execute(session *FtpSession, request *FtpRequest) {
+	// 只支持英语, 不带参数时恢复默认语言
+	switch strings.ToUpper(request.Argument) {
+	case "", "EN", "EN-US":
+		session.write(reply200CommandOkay, "Using English.")
+	default:
+		session.write(reply504CommandNotImplementedForThatParameter, "Unsupported language.")
+	}
+}
 
+func (cmd lang) Help() string {
+	return "[<language>] (change language)"
 }
 
 type list struct{}
 
 func (cmd list) Execute(session *FtpSession, request *FtpRequest) {
 
-	argument := request.Argument
-	root := session.FtpUser.HomeDir
-	path := filepath.Join(root, filepath.Join(session.CurrentDir, argument))
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
 
-	files, err := getFileList(path, new(listFileFormater))
+	files, err := getFileList(session.fileSystem(), path, new(listFileFormater))
 	if err != nil {
 		session.write(reply550RequestedActionNotTaken, "No such directory.")
 		return
@@ -203,68 +559,266 @@ func (cmd list) Execute(session *FtpSession, request *FtpRequest) {
 	session.writeData(files)
 }
 
-type md5 struct{}
+func (cmd list) Help() string {
+	return "[<pathname>] (list directory)"
+}
+
+type md5Command struct{}
 
-func (cmd md5) Execute(session *FtpSession, request *FtpRequest) {
+func (cmd md5Command) Execute(session *FtpSession, request *FtpRequest) {
+	if request.Argument == "" {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	sum, ok := fileChecksum(session, request.Argument, "MD5")
+	if ok {
+		session.write(reply251FileChecksum, request.Argument+" "+sum)
+	}
+}
+
+func (cmd md5Command) Help() string {
+	return "<pathname> (MD5 checksum of file)"
+}
+
+func (cmd md5Command) Feature(session *FtpSession) string {
+	return "MD5"
+}
 
+// 计算整个文件的摘要, 失败时向客户端返回错误信息
+func fileChecksum(session *FtpSession, name, algorithm string) (string, bool) {
+	path := session.getFilePath(name)
+	if !session.checkPermission(PermRead, path) {
+		return "", false
+	}
+	info, err := session.fileSystem().Stat(path)
+	if err != nil || info.IsDir() {
+		session.write(reply550RequestedActionNotTaken, "No such file: "+name)
+		return "", false
+	}
+
+	sum, _, err := hashFile(session.fileSystem(), path, findHashAlgorithm(algorithm), 0, -1)
+	if err != nil {
+		log.Print(err)
+		session.write(reply451RequestedActionAborted, "Error reading file: "+name)
+		return "", false
+	}
+	return strings.ToUpper(sum), true
 }
 
 type mfmt struct{}
 
 func (cmd mfmt) Execute(session *FtpSession, request *FtpRequest) {
+	args := strings.SplitN(request.Argument, " ", 2)
+	if len(args) != 2 || args[1] == "" {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	mtime, err := parseModifyTime(args[0])
+	if err != nil {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Invalid time value.")
+		return
+	}
+
+	setModifyTime(session, args[1], mtime)
+}
+
+func (cmd mfmt) Help() string {
+	return "<YYYYMMDDHHMMSS> <pathname> (set modification time)"
+}
+
+func (cmd mfmt) Feature(session *FtpSession) string {
+	return "MFMT"
+}
+
+// 修改文件的修改时间, MFMT 和旧式的 MDTM <time> <file> 共用
+func setModifyTime(session *FtpSession, name string, mtime time.Time) {
+	path := session.getFilePath(name)
+	if !session.checkPermission(PermChmod, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
+	if err != nil || info.IsDir() {
+		session.write(reply550RequestedActionNotTaken, "No such file.")
+		return
+	}
+
+	if err := session.fileSystem().Chtimes(path, mtime, mtime); err != nil {
+		session.write(reply550RequestedActionNotTaken, "Can't change modification time.")
+		return
+	}
 
+	session.write(reply213FileStatus, fmt.Sprintf("Modify=%s; %s", formatModifyTime(mtime), name))
 }
 
 type mmd5 struct{}
 
 func (cmd mmd5) Execute(session *FtpSession, request *FtpRequest) {
+	if request.Argument == "" {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
 
+	var sums []string
+	for _, name := range strings.Split(request.Argument, ",") {
+		name = strings.TrimSpace(name)
+		sum, ok := fileChecksum(session, name, "MD5")
+		if !ok {
+			return
+		}
+		sums = append(sums, name+" "+sum)
+	}
+	session.write(reply252FileChecksums, strings.Join(sums, ", "))
+}
+
+func (cmd mmd5) Help() string {
+	return "<pathname>[, <pathname>...] (MD5 checksums of files)"
 }
 
 type mdtm struct{}
 
 func (cmd mdtm) Execute(session *FtpSession, request *FtpRequest) {
+	if request.Argument == "" {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	// 部分客户端使用 MDTM <time> <file> 修改文件时间
+	if args := strings.SplitN(request.Argument, " ", 2); len(args) == 2 {
+		if mtime, err := parseModifyTime(args[0]); err == nil {
+			setModifyTime(session, args[1], mtime)
+			return
+		}
+	}
 
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
+	if err != nil || info.IsDir() {
+		session.write(reply550RequestedActionNotTaken, "No such file.")
+		return
+	}
+
+	session.write(reply213FileStatus, formatModifyTime(info.ModTime()))
+}
+
+func (cmd mdtm) Help() string {
+	return "[<YYYYMMDDHHMMSS>] <pathname> (show modification time)"
+}
+
+func (cmd mdtm) Feature(session *FtpSession) string {
+	return "MDTM"
 }
 
 type mlst struct{}
 
 func (cmd mlst) Execute(session *FtpSession, request *FtpRequest) {
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "No such file or directory.")
+		return
+	}
+
+	formater := mlsdFileFormater{facts: session.mlstFacts()}
+	line := formater.formatFacts(info) + delim + path
+	session.writeLines(reply250RequestedFileActionOkay, "Listing "+path, []string{line}, "End")
+}
 
+func (cmd mlst) Help() string {
+	return "[<pathname>] (machine-readable file information)"
+}
+
+func (cmd mlst) Feature(session *FtpSession) string {
+	return mlstFeature(session.mlstFacts())
 }
 
 type mkd struct{}
 
 func (cmd mkd) Execute(session *FtpSession, request *FtpRequest) {
-	abspath, _ := session.getFilePath(request.Argument)
-	if err := os.Mkdir(abspath, os.ModePerm); err != nil {
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermMkdir, path) {
+		return
+	}
+	if err := session.fileSystem().Mkdir(path); err != nil {
 		session.write(reply550RequestedActionNotTaken, "Can't create directory.")
 	} else {
 		session.write(reply257PathNameCreated, "directory created.")
 	}
 }
 
+func (cmd mkd) Help() string {
+	return "<pathname> (make directory)"
+}
+
 type mlsd struct{}
 
 func (cmd mlsd) Execute(session *FtpSession, request *FtpRequest) {
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "No such directory.")
+		return
+	}
+	if !info.IsDir() {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Not a directory.")
+		return
+	}
 
+	fs, err := session.fileSystem().ReadDir(path)
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "No such directory.")
+		return
+	}
+
+	formater := mlsdFileFormater{facts: session.mlstFacts()}
+
+	session.write(reply150FileStatusOkay, "Opening ASCII mode data connection for MLSD")
+
+	session.writeData(formater.format(fs))
+}
+
+func (cmd mlsd) Help() string {
+	return "[<pathname>] (machine-readable directory listing)"
 }
 
 type mode struct{}
 
 func (cmd mode) Execute(session *FtpSession, request *FtpRequest) {
+	// 只支持流模式
+	switch strings.ToUpper(request.Argument) {
+	case "":
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+	case "S":
+		session.write(reply200CommandOkay, "Mode set to S.")
+	default:
+		session.write(reply504CommandNotImplementedForThatParameter, "Unsupported transfer mode.")
+	}
+}
 
+func (cmd mode) Help() string {
+	return "S (set transfer mode)"
 }
 
 type nlst struct{}
 
 func (cmd nlst) Execute(session *FtpSession, request *FtpRequest) {
 
-	argument := request.Argument
-	root := session.FtpUser.HomeDir
-	path := filepath.Join(root, filepath.Join(session.CurrentDir, argument))
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
 
-	files, err := getFileList(path, new(nlstFileFormater))
+	files, err := getFileList(session.fileSystem(), path, new(nlstFileFormater))
 	if err != nil {
 		session.write(reply503BadSequenceOfCommands, "POR121T or PASV must be issued first.")
 		return
@@ -275,12 +829,20 @@ func (cmd nlst) Execute(session *FtpSession, request *FtpRequest) {
 	session.writeData(files)
 }
 
+func (cmd nlst) Help() string {
+	return "[<pathname>] (list file names)"
+}
+
 type noop struct{}
 
 func (cmd noop) Execute(session *FtpSession, request *FtpRequest) {
 	session.write(reply200CommandOkay, "Command NOOP okay.")
 }
 
+func (cmd noop) Help() string {
+	return "(no operation)"
+}
+
 type opts struct{}
 
 func (cmd opts) Execute(session *FtpSession, request *FtpRequest) {
@@ -297,7 +859,7 @@ func (cmd opts) Execute(session *FtpSession, request *FtpRequest) {
 	}
 
 	code := "OPTS_" + strings.ToUpper(args[0])
-	c := optsMap[code]
+	c := lookupCommand(session, code)
 	if c == nil {
 		session.write(reply502CommandNotImplemented, "OPTS not implemented.")
 		return
@@ -306,6 +868,10 @@ func (cmd opts) Execute(session *FtpSession, request *FtpRequest) {
 	c.Execute(session, request)
 }
 
+func (cmd opts) Help() string {
+	return "<command> [<options>] (set command options)"
+}
+
 type pass struct{}
 
 func (cmd pass) Execute(session *FtpSession, request *FtpRequest) {
@@ -321,32 +887,122 @@ func (cmd pass) Execute(session *FtpSession, request *FtpRequest) {
 		return
 	}
 
+	if session.FtpServer.opt.Anonymous != nil && isAnonymousUser(username) {
+		session.loginAnonymous(username, password)
+		return
+	}
+
 	ftpUser, err := session.FtpServer.opt.FtpUserManager.Authenticate(username, password)
 	if err != nil {
 		session.write(reply530NotLoggedIn, "Authentication failed.")
 		return
 	}
 
+	session.mutex.Lock()
 	session.IsLoginedIn = true
 	session.FtpUser = ftpUser
+	session.mutex.Unlock()
+	session.quotaUsage()
 	session.write(reply230UserLoggedIn, "User logged in, proceed.")
 }
 
+func (cmd pass) Help() string {
+	return "<password> (log in with password)"
+}
+
+func (cmd pass) RequireAuth() bool {
+	return false
+}
+
 type pasv struct{}
 
 func (cmd pasv) Execute(session *FtpSession, request *FtpRequest) {
+	if session.getAttribute(attributeEpsvAll) != "" {
+		session.write(reply503BadSequenceOfCommands, "PASV not allowed after EPSV ALL.")
+		return
+	}
+
+	local, ok := session.LocalAddr.(*net.TCPAddr)
+	if !ok {
+		session.write(reply425CantOpenDataConnection, "Can't open data connection.")
+		return
+	}
+
+	// 返回给客户端的地址, 默认为控制通道的本地地址
+	ip := local.IP
+	if addr := session.FtpServer.opt.PasvAddress; addr != "" {
+		ip = net.ParseIP(addr)
+	}
+	if ip.To4() == nil {
+		session.write(reply425CantOpenDataConnection, "Can't open passive connection on a non IPv4 address, use EPSV.")
+		return
+	}
+
+	conn := session.openPasvConn()
+	if conn == nil {
+		return
+	}
+
+	socket, err := encoderSocket(&net.TCPAddr{IP: ip, Port: conn.Addr().Port})
+	if err != nil {
+		session.CloseDataConn()
+		session.write(reply425CantOpenDataConnection, "Can't open data connection.")
+		return
+	}
+
+	session.write(reply227EnteringPassiveMode, fmt.Sprintf("Entering Passive Mode (%s).", socket))
+}
+
+func (cmd pasv) Help() string {
+	return "(enter passive mode)"
+}
 
+func (cmd pasv) Feature(session *FtpSession) string {
+	return "PASV"
 }
 
 type pbsz struct{}
 
 func (cmd pbsz) Execute(session *FtpSession, request *FtpRequest) {
+	if !session.isSecure() {
+		session.write(reply503BadSequenceOfCommands, "PBSZ requires a secure connection, use AUTH TLS first.")
+		return
+	}
+
+	if _, err := strconv.ParseUint(request.Argument, 10, 32); err != nil {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	// TLS 不需要保护缓冲区, 始终协商为0
+	session.setAttribute(attributePbsz, "0")
+	session.write(reply200CommandOkay, "PBSZ=0")
+}
 
+func (cmd pbsz) Help() string {
+	return "0 (set protection buffer size)"
+}
+
+func (cmd pbsz) RequireAuth() bool {
+	return false
+}
+
+func (cmd pbsz) Feature(session *FtpSession) string {
+	return "PBSZ"
+}
+
+func (cmd pbsz) Enabled(session *FtpSession) bool {
+	return session.FtpServer.opt.TLSConfig != nil
 }
 
 type port struct{}
 
 func (cmd port) Execute(session *FtpSession, request *FtpRequest) {
+	if session.getAttribute(attributeEpsvAll) != "" {
+		session.write(reply503BadSequenceOfCommands, "PORT not allowed after EPSV ALL.")
+		return
+	}
+
 	argument := request.Argument
 	if argument == "" {
 		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
@@ -359,38 +1015,49 @@ func (cmd port) Execute(session *FtpSession, request *FtpRequest) {
 		return
 	}
 
-	// TODO 判断是否开启被动模式IP检查再决定是否检查IP地址
-	if n, ok := session.RemoteAddr.(*net.TCPAddr); ok {
-		if !addr.IP.Equal(n.IP) {
-			session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
-			return
-		}
+	if session.openPortConn(addr) {
+		session.write(reply200CommandOkay, "Command PORT okay.")
 	}
+}
 
-	// TODO 绑定数据通道
-	conn, err := newPortModeConn(addr)
-	if err != nil {
-		log.Print(err)
-		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+func (cmd port) Help() string {
+	return "<h1,h2,h3,h4,p1,p2> (open active data connection)"
+}
+
+type prot struct{}
+
+func (cmd prot) Execute(session *FtpSession, request *FtpRequest) {
+	if session.getAttribute(attributePbsz) == "" {
+		session.write(reply503BadSequenceOfCommands, "PBSZ must be issued first.")
 		return
 	}
 
-	if session.DataConn != nil {
-		_ = session.DataConn.Close()
-		session.DataConn = nil
+	level := strings.ToUpper(request.Argument)
+	switch level {
+	case protClear, protPrivate:
+		session.setAttribute(attributeProt, level)
+		session.write(reply200CommandOkay, "Command PROT okay.")
+	case "S", "E":
+		session.write(reply536ProtLevelNotSupported, "PROT level not supported by mechanism.")
+	default:
+		session.write(reply504CommandNotImplementedForThatParameter, fmt.Sprintf("Command PROT not implemented for the parameter %s.", request.Argument))
 	}
+}
 
-	session.DataConn = conn
-
-	log.Printf("[%s] Enable PORT Mode, Destination: %s", session.RemoteAddr, addr)
-
-	session.write(reply200CommandOkay, "Command PORT okay.")
+func (cmd prot) Help() string {
+	return "C | P (set data channel protection level)"
 }
 
-type prot struct{}
+func (cmd prot) RequireAuth() bool {
+	return false
+}
 
-func (cmd prot) Execute(session *FtpSession, request *FtpRequest) {
+func (cmd prot) Feature(session *FtpSession) string {
+	return "PROT"
+}
 
+func (cmd prot) Enabled(session *FtpSession) bool {
+	return session.FtpServer.opt.TLSConfig != nil
 }
 
 type pwd struct{}
@@ -399,6 +1066,10 @@ func (cmd pwd) Execute(session *FtpSession, _ *FtpRequest) {
 	session.write(reply257PathNameCreated, fmt.Sprintf("\"%s\" is current directory.", session.CurrentDir))
 }
 
+func (cmd pwd) Help() string {
+	return "(print working directory)"
+}
+
 type quit struct{}
 
 func (cmd quit) Execute(session *FtpSession, request *FtpRequest) {
@@ -406,24 +1077,126 @@ func (cmd quit) Execute(session *FtpSession, request *FtpRequest) {
 	session.Close()
 }
 
+func (cmd quit) Help() string {
+	return "(close control connection)"
+}
+
+func (cmd quit) RequireAuth() bool {
+	return false
+}
+
+type rang struct{}
+
+func (cmd rang) Execute(session *FtpSession, request *FtpRequest) {
+	var start, end int64
+	if n, err := fmt.Sscanf(request.Argument, "%d %d", &start, &end); err != nil || n != 2 {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	// RANG 1 0 用于取消之前设置的范围
+	if start == 1 && end == 0 {
+		session.removeAttribute(attributeRange)
+		session.write(reply350RequestedFileActionPendingFurtherInformation, "Range reset.")
+		return
+	}
+	if start < 0 || end < start {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Invalid range.")
+		return
+	}
+
+	session.setAttribute(attributeRange, fmt.Sprintf("%d %d", start, end))
+	session.write(reply350RequestedFileActionPendingFurtherInformation, fmt.Sprintf("Restarting at %d. Ending byte %d.", start, end))
+}
+
+func (cmd rang) Help() string {
+	return "<start> <end> (set byte range for next transfer)"
+}
+
+func (cmd rang) Feature(session *FtpSession) string {
+	return "RANG STREAM"
+}
+
 type rein struct{}
 
 func (cmd rein) Execute(session *FtpSession, request *FtpRequest) {
+	session.CloseDataConn()
+
+	// 注销用户并清除会话状态, TLS 保护级别保持不变
+	s := session.FtpServer
+	s.mutex.Lock()
+	session.mutex.Lock()
+	if session.FtpUser != nil && session.FtpUser.Anonymous {
+		s.anonymousSessions--
+	}
+	session.IsLoginedIn = false
+	session.FtpUser = nil
+	session.CurrentDir = "/"
+	for key := range session.Attribute {
+		if key != attributePbsz && key != attributeProt {
+			delete(session.Attribute, key)
+		}
+	}
+	session.mutex.Unlock()
+	s.mutex.Unlock()
+
+	session.write(reply220ServiceReady, "Service ready for new user.")
+}
+
+func (cmd rein) Help() string {
+	return "(reinitialize session)"
+}
 
+func (cmd rein) RequireAuth() bool {
+	return false
 }
 
 type rest struct{}
 
 func (cmd rest) Execute(session *FtpSession, request *FtpRequest) {
+	offset, err := strconv.ParseInt(request.Argument, 10, 64)
+	if err != nil || offset < 0 {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	session.setAttribute(attributeRestOffset, strconv.FormatInt(offset, 10))
+	session.write(reply350RequestedFileActionPendingFurtherInformation, fmt.Sprintf("Restarting at %d. Send STORE or RETRIEVE to initiate transfer.", offset))
+}
+
+func (cmd rest) Help() string {
+	return "<offset> (restart next transfer at offset)"
+}
 
+func (cmd rest) Feature(session *FtpSession) string {
+	return "REST STREAM"
 }
 
 type retr struct{}
 
 func (cmd retr) Execute(session *FtpSession, request *FtpRequest) {
-	abspath, _ := session.getFilePath(request.Argument)
+	fs := session.fileSystem()
+	path := session.getFilePath(request.Argument)
+	offset, end := session.takeRange()
+
+	if !session.checkPermission(PermRead, path) {
+		return
+	}
+	fi, err := fs.Stat(path)
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "No such file or directory.")
+		return
+	}
+	if fi.IsDir() {
+		session.write(reply550RequestedActionNotTaken, "Not a plain file.")
+		return
+	}
+	if offset > fi.Size() {
+		session.write(reply554RequestedActionNotTakenInvalidRest, "Invalid REST parameter.")
+		return
+	}
 
-	f, err := os.Open(abspath)
+	f, err := fs.Open(path, offset)
 	if err != nil {
 		session.write(reply550RequestedActionNotTaken, "No such file or directory.")
 		return
@@ -431,26 +1204,48 @@ func (cmd retr) Execute(session *FtpSession, request *FtpRequest) {
 	defer func() {
 		_ = f.Close()
 	}()
-	if fi, err := os.Stat(abspath); err != nil || fi.IsDir() {
-		session.write(reply550RequestedActionNotTaken, "Not a plain file.")
-		return
+
+	// RANG 指定了结束位置时只发送范围内的数据, 结束位置包含在内
+	if end >= 0 {
+		f = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(f, end-offset+1), f}
 	}
 
 	session.write(reply150FileStatusOkay, "Data transfer starting.")
 	session.writeFile(f)
 }
 
+func (cmd retr) Help() string {
+	return "<pathname> (download file)"
+}
+
 type rmd struct{}
 
 func (cmd rmd) Execute(session *FtpSession, request *FtpRequest) {
-	abspath, _ := session.getFilePath(request.Argument)
-	if err := os.Remove(abspath); err != nil {
+	fs := session.fileSystem()
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermRmdir, path) {
+		return
+	}
+	// FileSystem.Remove 也能删除文件, 删除文件需要使用 DELE 和 PermDelete
+	fi, err := fs.Stat(path)
+	if err != nil || !fi.IsDir() {
+		session.write(reply550RequestedActionNotTaken, "Not a directory.")
+		return
+	}
+	if err := fs.Remove(path); err != nil {
 		session.write(reply450RequestedFileActionNotTaken, "Can't remove.")
 	} else {
 		session.write(reply250RequestedFileActionOkay, "removed.")
 	}
 }
 
+func (cmd rmd) Help() string {
+	return "<pathname> (remove directory)"
+}
+
 type rnfr struct{}
 
 func (cmd rnfr) Execute(session *FtpSession, request *FtpRequest) {
@@ -460,16 +1255,23 @@ func (cmd rnfr) Execute(session *FtpSession, request *FtpRequest) {
 		return
 	}
 
-	abspath, _ := session.getFilePath(arg)
-	_, err := os.Stat(abspath)
+	path := session.getFilePath(arg)
+	if !session.checkPermission(PermRename, path) {
+		return
+	}
+	_, err := session.fileSystem().Stat(path)
 	if err != nil {
 		session.write(reply550RequestedActionNotTaken, "File unavailable.")
 	} else {
-		session.setAttribute(attributeRenameFrom, abspath)
+		session.setAttribute(attributeRenameFrom, path)
 		session.write(reply350RequestedFileActionPendingFurtherInformation, "Requested file action pending further information.")
 	}
 }
 
+func (cmd rnfr) Help() string {
+	return "<pathname> (rename from)"
+}
+
 type rnto struct{}
 
 func (cmd rnto) Execute(session *FtpSession, request *FtpRequest) {
@@ -485,39 +1287,73 @@ func (cmd rnto) Execute(session *FtpSession, request *FtpRequest) {
 		return
 	}
 
-	abspath, _ := session.getFilePath(arg)
-	if err := os.Rename(frname, abspath); err != nil {
+	path := session.getFilePath(arg)
+	if !session.checkPermission(PermRename, path) {
+		return
+	}
+
+	// 覆盖已有文件时释放其占用的配额
+	fs := session.fileSystem()
+	target, err := fs.Stat(path)
+	if err != nil || target.IsDir() || path == frname {
+		target = nil
+	}
+	if err := fs.Rename(frname, path); err != nil {
 		session.write(reply553RequestedActionNotTakenFileNameNotAllowed, "Rename error.")
 	} else {
+		if usage := session.quotaUsage(); usage != nil && target != nil {
+			usage.release(target.Size(), 1)
+		}
 		session.removeAttribute(attributeRenameFrom)
 		session.write(reply250RequestedFileActionOkay, "Requested file action okay, file renamed.")
 	}
 }
 
+func (cmd rnto) Help() string {
+	return "<pathname> (rename to)"
+}
+
 type site struct{}
 
 func (cmd site) Execute(session *FtpSession, request *FtpRequest) {
-	argument := request.Argument
-	if argument == "" {
+	if request.Argument == "" {
 		session.write(reply200CommandOkay, "Command SITE okay. Use SITE HELP to get more information.")
 		return
 	}
 
-	code := "SITE_" + strings.ToUpper(argument)
+	// 拆分子命令和参数, 子命令以 SITE_<NAME> 为名注册
+	params := strings.SplitN(strings.TrimSpace(request.Argument), " ", 2)
+	name := strings.ToUpper(params[0])
+	sub := &FtpRequest{
+		Line:       request.Line,
+		Command:    "SITE_" + name,
+		ReceivedAt: request.ReceivedAt,
+	}
+	if len(params) == 2 {
+		sub.Argument = strings.TrimSpace(params[1])
+	}
 
-	c := commands[code]
+	c := lookupCommand(session, sub.Command)
 	if c == nil {
-		session.write(reply502CommandNotImplemented, "Command SITE not implemented for "+argument)
+		session.write(reply502CommandNotImplemented, "Command SITE not implemented for "+params[0])
 		return
 	}
 
-	c.Execute(session, request)
+	c.Execute(session, sub)
+}
+
+func (cmd site) Help() string {
+	return "<command> [<arguments>] (site specific commands)"
 }
 
 type size struct{}
 
 func (cmd size) Execute(session *FtpSession, request *FtpRequest) {
-	_, info, err := session.buildPath(request.Argument)
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
 	if err != nil {
 		session.write(reply550RequestedActionNotTaken, "No such file or directory.")
 		return
@@ -531,51 +1367,205 @@ func (cmd size) Execute(session *FtpSession, request *FtpRequest) {
 	session.write(reply213FileStatus, strconv.FormatInt(info.Size(), 10))
 }
 
+func (cmd size) Help() string {
+	return "<pathname> (show file size)"
+}
+
+func (cmd size) Feature(session *FtpSession) string {
+	return "SIZE"
+}
+
 type siteDescuser struct{}
 
 func (cmd siteDescuser) Execute(session *FtpSession, _ *FtpRequest) {
 	u := session.FtpUser
-	message := fmt.Sprintf("\nusername : %s\npassword : ******\nhome dir : %s", u.Username, u.HomeDir)
-	session.write(reply200CommandOkay, message)
+	lines := []string{"username : " + u.Username, "password : ******", "home dir : " + u.HomeDir}
+	session.writeLines(reply200CommandOkay, "User information:", lines, "End")
+}
+
+// 匿名用户的主目录是服务器的本地路径, 不向匿名用户显示
+func (cmd siteDescuser) Enabled(session *FtpSession) bool {
+	return session.FtpUser == nil || !session.FtpUser.Anonymous
+}
+
+func (cmd siteDescuser) Help() string {
+	return "(display user information)"
 }
 
 type siteHelp struct{}
 
-func (cmd siteHelp) Execute(session *FtpSession, _ *FtpRequest) {
-	message := "\nDESCUSER : display user information." +
-		"\nHELP     : display this message." +
-		"\nSTAT     : show statistics." +
-		"\nWHO      : display all connected users." +
-		"\nZONE     : display timezone."
-	session.write(reply200CommandOkay, message)
+func (cmd siteHelp) Execute(session *FtpSession, request *FtpRequest) {
+	if request.Argument != "" {
+		name := strings.ToUpper(request.Argument)
+		h, ok := lookupCommand(session, "SITE_"+name).(Helper)
+		if !ok {
+			session.write(reply502CommandNotImplemented, "Unknown SITE command "+request.Argument+".")
+			return
+		}
+		session.write(reply214HelpMessage, "Syntax: SITE "+name+" "+h.Help())
+		return
+	}
+
+	var lines []string
+	for _, name := range siteCommandNames(session) {
+		line := name
+		if h, ok := lookupCommand(session, "SITE_"+name).(Helper); ok {
+			line = fmt.Sprintf("%-10s %s", name, h.Help())
+		}
+		lines = append(lines, line)
+	}
+	session.writeLines(reply214HelpMessage, "The following SITE commands are recognized.", lines, "Help OK.")
+}
+
+func (cmd siteHelp) Help() string {
+	return "[<command>] (display this message)"
+}
+
+// 当前会话可用的 SITE 子命令名, 按字母排序
+func siteCommandNames(session *FtpSession) []string {
+	var names []string
+	for name, c := range session.FtpServer.registeredCommands() {
+		if strings.HasPrefix(name, "SITE_") && commandEnabled(session, c) {
+			names = append(names, strings.TrimPrefix(name, "SITE_"))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type siteQuota struct{}
+
+func (cmd siteQuota) Execute(session *FtpSession, _ *FtpRequest) {
+	usage := session.quotaUsage()
+	if usage == nil {
+		session.write(reply200CommandOkay, "No quota.")
+		return
+	}
+
+	limit := func(n int64) string {
+		if n <= 0 {
+			return "unlimited"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+	quota, bytes, files := usage.usage()
+	lines := []string{
+		fmt.Sprintf("bytes : %d / %s", bytes, limit(quota.MaxBytes)),
+		fmt.Sprintf("files : %d / %s", files, limit(quota.MaxFiles)),
+	}
+	first := "Quota for user " + session.FtpUser.Username + ":"
+	if session.groupQuota() != nil {
+		first = "Quota for group " + session.FtpUser.Group + ":"
+	}
+	session.writeLines(reply200CommandOkay, first, lines, "End")
+}
+
+func (cmd siteQuota) Help() string {
+	return "(show quota usage)"
 }
 
 type siteStat struct{}
 
 func (cmd siteStat) Execute(session *FtpSession, _ *FtpRequest) {
-	message := "\nwill todo"
-	session.write(reply200CommandOkay, message)
+	sessions := session.FtpServer.Sessions()
+	users, transfers := 0, 0
+	for _, info := range sessions {
+		if info.Username != "" {
+			users++
+		}
+		if info.Transfer != nil {
+			transfers++
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("sessions  : %d", len(sessions)),
+		fmt.Sprintf("logged in : %d", users),
+		fmt.Sprintf("transfers : %d", transfers),
+	}
+	session.writeLines(reply200CommandOkay, "Server statistics:", lines, "End")
+}
+
+func (cmd siteStat) Help() string {
+	return "(show statistics)"
 }
 
 type siteWho struct{}
 
+// 只列出当前用户自己的会话, 不向其他用户暴露连接地址和正在访问的文件
 func (cmd siteWho) Execute(session *FtpSession, _ *FtpRequest) {
-	message := "\nwill todo"
-	session.write(reply200CommandOkay, message)
+	now := time.Now()
+	user := session.FtpUser.Username
+	var lines []string
+	for _, info := range session.FtpServer.Sessions() {
+		if info.Username != user {
+			continue
+		}
+		transfer := "-"
+		if t := info.Transfer; t != nil {
+			transfer = fmt.Sprintf("%s %s (%d bytes)", t.Command, t.Argument, t.Bytes)
+		}
+		lines = append(lines, fmt.Sprintf("%-4s %-12s %-21s %s idle %-6s %s %s",
+			info.ID, user, info.RemoteAddr, info.ConnectAt.Format("2006-01-02 15:04:05"),
+			now.Sub(info.LastAccessAt).Truncate(time.Second), info.CurrentDir, transfer))
+	}
+	session.writeLines(reply200CommandOkay, "Connected users:", lines, "End")
+}
+
+// 匿名用户共用同一个用户名, 不能查看其他匿名会话
+func (cmd siteWho) Enabled(session *FtpSession) bool {
+	return session.FtpUser == nil || !session.FtpUser.Anonymous
+}
+
+func (cmd siteWho) Help() string {
+	return "(display your connected sessions)"
 }
 
 type siteZone struct{}
 
 func (cmd siteZone) Execute(session *FtpSession, _ *FtpRequest) {
 	s := time.Now()
-	session.write(reply200CommandOkay, s.String())
+	session.write(reply200CommandOkay, s.Format("UTC-07:00 MST"))
+}
+
+func (cmd siteZone) Help() string {
+	return "(display timezone)"
 }
 
-//
 type stat struct{}
 
 func (cmd stat) Execute(session *FtpSession, request *FtpRequest) {
+	if request.Argument == "" {
+		dataType := session.getAttribute(attributeDataType)
+		if dataType == "" {
+			dataType = dataTypeAscii
+		}
+		session.writeLines(reply211SystemStatusreply, "FTP server status:", []string{
+			"Connected to " + session.RemoteAddr.String(),
+			"Logged in as " + session.FtpUser.Username,
+			"TYPE: " + dataType + ", STRUcture: File, MODE: Stream",
+		}, "End of status")
+		return
+	}
+
+	// 通过控制通道返回目录列表
+	path := session.getFilePath(request.Argument)
+	if !session.checkPermission(PermList, path) {
+		return
+	}
+	files, err := getFileList(session.fileSystem(), path, new(listFileFormater))
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "No such file or directory.")
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(files), newline), newline)
+	if len(files) == 0 {
+		lines = nil
+	}
+	session.writeLines(reply213FileStatus, "Status of "+path+":", lines, "End of status")
+}
 
+func (cmd stat) Help() string {
+	return "[<pathname>] (show server or file status)"
 }
 
 type stor struct{}
@@ -583,6 +1573,7 @@ type stor struct{}
 func (cmd stor) Execute(session *FtpSession, request *FtpRequest) {
 
 	arg := request.Argument
+	offset, end := session.takeRange()
 
 	if arg == "" {
 		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
@@ -595,45 +1586,139 @@ func (cmd stor) Execute(session *FtpSession, request *FtpRequest) {
 		return
 	}
 
-	session.write(reply150FileStatusOkay, "Data transfer starting.")
-
-	abspath, _ := session.getFilePath(arg)
+	fs := session.fileSystem()
+	path := session.getFilePath(arg)
+	if !session.checkPermission(PermWrite, path) {
+		return
+	}
 
-	sz, err := saveFile(abspath, session.DataConn)
+	// 匿名用户断点续传需要追加权限, 没有删除权限时只能新建文件, 不能覆盖已有文件.
+	// 只新建文件时不检查文件是否存在, 文件存在时和其他创建失败的情况返回相同的响应
+	flag := 0
+	if session.FtpUser.Anonymous {
+		if offset > 0 && !session.checkPermission(PermAppend, path) {
+			return
+		}
+		if offset == 0 && session.FtpUser.permission(path)&PermDelete == 0 {
+			flag = os.O_EXCL
+		}
+	}
 
-	if err != nil {
-		session.write(reply551RequestedActionAbortedPageTypeUnknown, "Error on input file.")
-	} else {
-		message := "Closing data connection, sent " + strconv.FormatInt(sz, 10) + " bytes"
-		session.write(reply226ClosingDataConnection, message)
+	var old os.FileInfo
+	if flag != os.O_EXCL {
+		if fi, err := fs.Stat(path); err == nil {
+			old = fi
+		}
 	}
 
-	session.CloseDataConn()
-}
+	// 断点续传时偏移量不能超过已上传的大小
+	if offset > 0 && (old == nil || old.IsDir() || offset > old.Size()) {
+		session.write(reply554RequestedActionNotTakenInvalidRest, "Invalid REST parameter.")
+		return
+	}
+	// 从0开始写入时 FileSystem.Create 会清空文件, 不能只覆盖已有文件开头的一部分
+	if offset == 0 && end >= 0 && old != nil && old.Size() > end+1 {
+		session.write(reply554RequestedActionNotTakenInvalidRest, "Invalid RANG parameter.")
+		return
+	}
 
-func saveFile(abspath string, conn DataConn) (int64, error) {
-	file, err := os.OpenFile(abspath, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	file, err := session.createUpload(path, offset, flag, old)
+	if err == errQuotaExceeded {
+		session.write(reply552RequestedFileActionAbortedExceededStorage, "Exceeded storage allocation.")
+		return
+	}
 	if err != nil {
-		return 0, err
+		session.write(reply550RequestedActionNotTaken, "Can't create file.")
+		return
+	}
+	if end >= 0 {
+		file = &rangeWriter{WriteCloser: file, remain: end - offset + 1}
 	}
 
-	defer func() {
-		_ = file.Close()
-	}()
+	session.write(reply150FileStatusOkay, "Data transfer starting.")
+	session.readFile(file, "")
+}
 
-	return io.Copy(file, conn)
+func (cmd stor) Help() string {
+	return "<pathname> (upload file)"
 }
 
 type stou struct{}
 
 func (cmd stou) Execute(session *FtpSession, request *FtpRequest) {
+	session.takeRange()
+
+	// 检查数据通道是否打开
+	if session.DataConn == nil {
+		session.write(reply503BadSequenceOfCommands, "PORT or PASV must be issued first.")
+		return
+	}
+
+	// 以独占方式创建文件, 名字被其他上传占用时换一个重试
+	var name string
+	var file io.WriteCloser
+	err := os.ErrExist
+	for i := 0; i < 10 && os.IsExist(err); i++ {
+		if name, err = uniqueFileName(request.Argument); err != nil {
+			break
+		}
+		path := session.getFilePath(name)
+		if !session.checkPermission(PermWrite, path) {
+			return
+		}
+		file, err = session.createUpload(path, 0, os.O_EXCL, nil)
+	}
+	if os.IsExist(err) {
+		session.write(reply450RequestedFileActionNotTaken, "Can't create unique file name.")
+		return
+	}
+	if err == errQuotaExceeded {
+		session.write(reply552RequestedFileActionAbortedExceededStorage, "Exceeded storage allocation.")
+		return
+	}
+	if err != nil {
+		session.write(reply550RequestedActionNotTaken, "Can't create file.")
+		return
+	}
+
+	session.write(reply150FileStatusOkay, "FILE: "+name)
+	session.readFile(file, name)
+}
+
+func (cmd stou) Help() string {
+	return "[<prefix>] (upload file with unique name)"
+}
+
+// 生成一个随机的文件名, 客户端指定了文件名时以它为前缀
+func uniqueFileName(prefix string) (string, error) {
+	prefix = pathpkg.Base("/" + prefix)
+	if prefix == "/" {
+		prefix = "ftp"
+	}
 
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + "." + hex.EncodeToString(b), nil
 }
 
 type stru struct{}
 
 func (cmd stru) Execute(session *FtpSession, request *FtpRequest) {
+	// 只支持文件结构
+	switch strings.ToUpper(request.Argument) {
+	case "":
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+	case "F":
+		session.write(reply200CommandOkay, "Structure set to F.")
+	default:
+		session.write(reply504CommandNotImplementedForThatParameter, "Unsupported file structure.")
+	}
+}
 
+func (cmd stru) Help() string {
+	return "F (set file structure)"
 }
 
 type syst struct{}
@@ -642,6 +1727,10 @@ func (cmd syst) Execute(session *FtpSession, request *FtpRequest) {
 	session.write(reply215NameSystemType, fmt.Sprintf("UNIX Type: %s", session.FtpServer.opt.Name))
 }
 
+func (cmd syst) Help() string {
+	return "(show system type)"
+}
+
 type typeCommand struct{}
 
 func (cmd typeCommand) Execute(session *FtpSession, request *FtpRequest) {
@@ -664,10 +1753,19 @@ func (cmd typeCommand) Execute(session *FtpSession, request *FtpRequest) {
 	session.write(reply200CommandOkay, "TYPE Command Okay.")
 }
 
+func (cmd typeCommand) Help() string {
+	return "A | I (set transfer type)"
+}
+
 type user struct{}
 
 func (cmd user) Execute(session *FtpSession, request *FtpRequest) {
 	username := request.Argument
+
+	if session.FtpServer.opt.ForceTLS && !session.isSecure() {
+		session.write(reply534RequestDeniedForPolicyReasons, "Policy requires TLS, use AUTH TLS first.")
+		return
+	}
 	if session.IsLoginedIn {
 		if session.FtpUser.Username == username {
 			session.write(reply230UserLoggedIn, "Already logged-in.")
@@ -678,13 +1776,114 @@ func (cmd user) Execute(session *FtpSession, request *FtpRequest) {
 	}
 
 	session.setAttribute(attributeUserArgument, username)
+	if session.FtpServer.opt.Anonymous != nil && isAnonymousUser(username) {
+		session.write(reply331UserNameOkayNeedPassword, "Anonymous login okay, send your email address as password.")
+		return
+	}
 	session.write(reply331UserNameOkayNeedPassword, "User name okay, need password.")
 }
 
+func (cmd user) Help() string {
+	return "<username> (log in with user name)"
+}
+
+func (cmd user) RequireAuth() bool {
+	return false
+}
+
+type optsHash struct{}
+
+func (cmd optsHash) Execute(session *FtpSession, request *FtpRequest) {
+	args := strings.SplitN(request.Argument, " ", 2)
+	if len(args) == 1 {
+		session.write(reply200CommandOkay, session.hashAlgorithm().name)
+		return
+	}
+
+	algo := findHashAlgorithm(strings.TrimSpace(args[1]))
+	if algo == nil {
+		session.write(reply504CommandNotImplementedForThatParameter, "Unknown algorithm.")
+		return
+	}
+
+	session.setAttribute(attributeHash, algo.name)
+	session.write(reply200CommandOkay, algo.name)
+}
+
 type optsMlst struct{}
 
 func (cmd optsMlst) Execute(session *FtpSession, request *FtpRequest) {
+	arg := ""
+	if args := strings.SplitN(request.Argument, " ", 2); len(args) == 2 {
+		arg = args[1]
+	}
 
+	facts := parseMlstFacts(arg)
+	session.setAttribute(attributeMlstFacts, strings.Join(facts, ";"))
+
+	selected := ""
+	for _, fact := range facts {
+		selected += fact + ";"
+	}
+	session.write(reply200CommandOkay, "MLST OPTS "+selected)
+}
+
+// XCRC/XMD5/XSHA1/XSHA256/XSHA512 <file> [start [end]], end为结束位置(不包含)
+type xhash struct {
+	algorithm string
+}
+
+func (cmd xhash) Execute(session *FtpSession, request *FtpRequest) {
+	args := strings.Fields(request.Argument)
+
+	// 文件名之后的数字参数为起止位置
+	var positions []int64
+	for len(args) > 1 && len(positions) < 2 {
+		n, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+		if err != nil {
+			break
+		}
+		positions = append([]int64{n}, positions...)
+		args = args[:len(args)-1]
+	}
+	if len(args) == 0 {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+		return
+	}
+
+	path := session.getFilePath(strings.Join(args, " "))
+	if !session.checkPermission(PermRead, path) {
+		return
+	}
+	info, err := session.fileSystem().Stat(path)
+	if err != nil || info.IsDir() {
+		session.write(reply550RequestedActionNotTaken, "No such file.")
+		return
+	}
+
+	start, length := int64(0), int64(-1)
+	if len(positions) > 0 {
+		start = positions[0]
+	}
+	if len(positions) > 1 {
+		length = positions[1] - start
+	}
+	if start < 0 || start > info.Size() || (len(positions) > 1 && length < 0) {
+		session.write(reply501SyntaxErrorInParametersOrArguments, "Invalid range.")
+		return
+	}
+
+	sum, _, err := hashFile(session.fileSystem(), path, findHashAlgorithm(cmd.algorithm), start, length)
+	if err != nil {
+		log.Print(err)
+		session.write(reply451RequestedActionAborted, "Error reading file.")
+		return
+	}
+	session.write(reply250RequestedFileActionOkay, strings.ToUpper(sum))
+}
+
+func (cmd xhash) Help() string {
+	return "<pathname> [<start> [<end>]] (" + cmd.algorithm + " checksum of file)"
 }
 
 type optsUTF8 struct{}
@@ -692,3 +1891,7 @@ type optsUTF8 struct{}
 func (cmd optsUTF8) Execute(session *FtpSession, request *FtpRequest) {
 	session.write(reply200CommandOkay, "Command OPTS okay.")
 }
+
+func (cmd optsUTF8) Feature(session *FtpSession) string {
+	return "UTF8"
+}
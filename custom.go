@@ -23,3 +23,17 @@ func countLink(f os.FileInfo) string {
 	}
 	return "  1"
 }
+
+func fileUnique(f os.FileInfo) string {
+	if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+		return strconv.FormatUint(uint64(stat.Dev), 16) + "U" + strconv.FormatUint(uint64(stat.Ino), 16)
+	}
+	return ""
+}
+
+func fileOwner(f os.FileInfo) (string, string) {
+	if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+		return strconv.FormatUint(uint64(stat.Uid), 10), strconv.FormatUint(uint64(stat.Gid), 10)
+	}
+	return "", ""
+}
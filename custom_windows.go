@@ -7,3 +7,11 @@ import "os"
 func countLink(_ os.FileInfo) string {
 	return "1"
 }
+
+func fileUnique(_ os.FileInfo) string {
+	return ""
+}
+
+func fileOwner(_ os.FileInfo) (string, string) {
+	return "", ""
+}
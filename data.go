@@ -1,9 +1,12 @@
 package ftpd
 
 import (
+	"crypto/tls"
 	"io"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 )
 
 type DataConn interface {
@@ -14,7 +17,7 @@ type DataConn interface {
 }
 
 type portModeConn struct {
-	conn       *net.TCPConn
+	conn       net.Conn
 	remoteAddr net.TCPAddr
 }
 
@@ -23,7 +26,7 @@ func (c *portModeConn) Read(b []byte) (int, error) {
 }
 
 func (c *portModeConn) ReadFrom(r io.Reader) (int64, error) {
-	return c.conn.ReadFrom(r)
+	return readFrom(c.conn, r)
 }
 
 func (c *portModeConn) Write(b []byte) (int, error) {
@@ -31,7 +34,9 @@ func (c *portModeConn) Write(b []byte) (int, error) {
 	if err != nil {
 		return sz, err
 	}
-	err = c.conn.CloseWrite()
+	if cw, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		err = cw.CloseWrite()
+	}
 	return sz, err
 }
 
@@ -40,61 +45,204 @@ func (c *portModeConn) Close() error {
 }
 
 type pasvModeConn struct {
-	conn       *net.TCPConn
+	listener   *net.TCPListener
+	conn       net.Conn
 	remoteAddr net.TCPAddr
-	mutex      sync.Mutex
+	timeout    time.Duration
+	// 传输停滞的超时时间
+	idleTimeout time.Duration
+	tlsConfig   *tls.Config
+	mutex       sync.Mutex
 }
 
-func (c *pasvModeConn) Read(b []byte) (int, error) {
+// 被动模式下数据通道在第一次读写时才接受客户端的连接, 只接受一个来自控制通道同一IP的连接.
+// 等待连接和读写时不持有锁, 以便其他goroutine可以通过 Close 中断
+func (c *pasvModeConn) connect() (net.Conn, error) {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	if c.conn != nil || c.listener == nil {
+		defer c.mutex.Unlock()
+		if c.conn == nil {
+			return nil, ErrDataConnClosed
+		}
+		return c.conn, nil
+	}
+	listener := c.listener
+	c.mutex.Unlock()
 
-	return c.conn.Read(b)
-}
+	conn, err := c.accept(listener)
 
-func (c *pasvModeConn) ReadFrom(r io.Reader) (int64, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	_ = listener.Close()
+	if c.listener == nil {
+		// 等待期间已被关闭
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return nil, ErrDataConnClosed
+	}
+	c.listener = nil
+	if err != nil {
+		return nil, err
+	}
+	c.conn = secureDataConn(newDeadlineConn(conn, c.idleTimeout), c.tlsConfig)
+	return c.conn, nil
+}
+
+func (c *pasvModeConn) accept(listener *net.TCPListener) (net.Conn, error) {
+	if c.timeout > 0 {
+		if err := listener.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+
+		// 拒绝非控制通道客户端的连接, 防止数据通道被劫持
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.Equal(c.remoteAddr.IP) {
+			return conn, nil
+		}
+		_ = conn.Close()
+	}
+}
 
-	return c.conn.ReadFrom(r)
+func (c *pasvModeConn) Addr() *net.TCPAddr {
+	return c.listener.Addr().(*net.TCPAddr)
 }
 
-func (c *pasvModeConn) Write(b []byte) (int, error) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+func (c *pasvModeConn) Read(b []byte) (int, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Read(b)
+}
 
-	return c.conn.Write(b)
+func (c *pasvModeConn) ReadFrom(r io.Reader) (int64, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+	return readFrom(conn, r)
+}
+
+func (c *pasvModeConn) Write(b []byte) (int, error) {
+	conn, err := c.connect()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(b)
 }
 
 func (c *pasvModeConn) Close() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	return c.conn.Close()
+	if c.listener != nil {
+		_ = c.listener.Close()
+		c.listener = nil
+	}
+	if c.conn != nil {
+		return c.conn.Close()
+	}
+	return nil
 }
 
-func newPortModeConn(addr *net.TCPAddr) (DataConn, error) {
-	conn, err := net.DialTCP("tcp", nil, addr)
+func newPortModeConn(addr *net.TCPAddr, timeout, idleTimeout time.Duration, tlsConfig *tls.Config) (DataConn, error) {
+	conn, err := net.DialTimeout("tcp", addr.String(), timeout)
 	if err != nil {
 		return nil, err
 	}
 
 	c := new(portModeConn)
-	c.conn = conn
+	c.conn = secureDataConn(newDeadlineConn(conn, idleTimeout), tlsConfig)
 	c.remoteAddr = *addr
 
 	return c, nil
 }
 
-func newPasvModeConn(addr *net.TCPAddr) (DataConn, error) {
-	conn, err := net.DialTCP("tcp", nil, addr)
+// 在 [minPort, maxPort] 范围内监听一个端口, 范围为空时由系统分配端口
+func newPasvModeConn(ip net.IP, minPort, maxPort int, remoteAddr *net.TCPAddr, timeout, idleTimeout time.Duration, tlsConfig *tls.Config) (*pasvModeConn, error) {
+	listener, err := listenPasv(ip, minPort, maxPort)
 	if err != nil {
 		return nil, err
 	}
 
-	c := new(portModeConn)
-	c.conn = conn
-	c.remoteAddr = *addr
+	c := new(pasvModeConn)
+	c.listener = listener
+	c.remoteAddr = *remoteAddr
+	c.timeout = timeout
+	c.idleTimeout = idleTimeout
+	c.tlsConfig = tlsConfig
 
 	return c, nil
 }
+
+func listenPasv(ip net.IP, minPort, maxPort int) (*net.TCPListener, error) {
+	if minPort <= 0 || maxPort < minPort {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+
+	// 从随机位置开始尝试, 避免并发会话总是争抢同一个端口
+	n := maxPort - minPort + 1
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := minPort + (start+i)%n
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, ErrPasvPortUnavailable
+}
+
+// PROT P 时数据通道使用TLS加密, 无论主动模式还是被动模式服务器都是TLS的服务端
+func secureDataConn(conn net.Conn, tlsConfig *tls.Config) net.Conn {
+	if tlsConfig == nil {
+		return conn
+	}
+	return tls.Server(conn, tlsConfig)
+}
+
+// 每次读写前刷新超时时间, 传输停滞超过timeout时读写返回超时错误.
+// 没有实现 io.ReaderFrom, 复制文件时会逐块写入以便刷新超时时间
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func newDeadlineConn(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &deadlineConn{Conn: conn, timeout: timeout}
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	_ = c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+func (c *deadlineConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// TLS连接没有实现 io.ReaderFrom, 只能退回到普通的复制
+func readFrom(conn net.Conn, r io.Reader) (int64, error) {
+	if rf, ok := conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(struct{ io.Writer }{conn}, r)
+}
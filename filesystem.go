@@ -0,0 +1,147 @@
+package ftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSystem 是FTP会话访问文件的接口, 所有路径都是FTP用户所看到的以 '/' 分隔的绝对路径
+type FileSystem interface {
+	// 获取文件或目录的信息
+	Stat(path string) (os.FileInfo, error)
+	// 列出目录下的文件, 按文件名排序
+	ReadDir(path string) ([]os.FileInfo, error)
+	// 从offset处开始读取文件
+	Open(path string, offset int64) (io.ReadCloser, error)
+	// 创建文件并从offset处开始写入, offset为0时清空原有内容
+	Create(path string, offset int64) (io.WriteCloser, error)
+	// 创建新文件, 文件已存在时返回的错误满足 os.IsExist
+	CreateNew(path string) (io.WriteCloser, error)
+	// 在文件末尾追加内容, 文件不存在时创建
+	Append(path string) (io.WriteCloser, error)
+	// 删除文件或空目录
+	Remove(path string) error
+	Rename(from, to string) error
+	Mkdir(path string) error
+	Chtimes(path string, atime, mtime time.Time) error
+}
+
+// 非本地文件系统使用的文件信息
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+// SymlinkPolicy 决定本地文件系统如何处理用户目录中的符号链接
+type SymlinkPolicy int
+
+const (
+	// 只跟随目标仍然在根目录下的符号链接(默认)
+	SymlinkFollowWithinRoot SymlinkPolicy = iota
+	// 不跟随任何符号链接
+	SymlinkNeverFollow
+	// 跟随目标在根目录或 SymlinkTargets 所列目录下的符号链接
+	SymlinkAllowTargets
+)
+
+// 符号链接的最大跟随次数, 与Linux内核的限制相同
+const maxSymlinkFollows = 40
+
+var (
+	errSymlinkNotAllowed = errors.New("symlink not allowed")
+	errSymlinkLoop       = errors.New("too many levels of symbolic links")
+)
+
+// LocalFileSystem 将FTP路径映射到本地磁盘Root目录下, 路径中的每一级符号链接都会被检查,
+// 解析后的目标不会超出Root(以及 SymlinkTargets)
+type LocalFileSystem struct {
+	Root           string
+	Symlinks       SymlinkPolicy
+	SymlinkTargets []string
+
+	mutex sync.Mutex
+	// 解析符号链接后的Root, 第一次成功解析后缓存
+	root string
+}
+
+func NewLocalFileSystem(root string) *LocalFileSystem {
+	return &LocalFileSystem{Root: root}
+}
+
+// 返回解析符号链接后的Root的绝对路径
+func (fs *LocalFileSystem) rootDir() (string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if fs.root != "" {
+		return fs.root, nil
+	}
+
+	root, err := filepath.EvalSymlinks(fs.Root)
+	if err != nil {
+		return "", err
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return "", err
+	}
+	fs.root = root
+	return root, nil
+}
+
+// 返回包含target的允许目录, 不允许时返回空
+func (fs *LocalFileSystem) allowedBase(root, target string) string {
+	if isSubPath(root, target) {
+		return root
+	}
+	if fs.Symlinks != SymlinkAllowTargets {
+		return ""
+	}
+	for _, dir := range fs.SymlinkTargets {
+		dir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if dir, err = filepath.Abs(dir); err == nil && isSubPath(dir, target) {
+			return dir
+		}
+	}
+	return ""
+}
+
+func isSubPath(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// 拆分FTP路径, 按字面处理 ".." 保证不会超出根目录
+func splitLocalPath(path string) []string {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			if len(names) > 0 {
+				names = names[:len(names)-1]
+			}
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,312 @@
+package ftpd
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 以不跟随符号链接的方式打开目录
+func openDirAt(dir int, name string) (int, error) {
+	return unix.Openat(dir, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+}
+
+func readlinkAt(dir int, name string) (string, error) {
+	for size := 128; ; size *= 2 {
+		buf := make([]byte, size)
+		n, err := unix.Readlinkat(dir, name, buf)
+		if err != nil {
+			return "", err
+		}
+		if n < size {
+			return string(buf[:n]), nil
+		}
+	}
+}
+
+// 获取dir下name本身(不跟随符号链接)的信息
+func lstatAt(dir int, name string) (os.FileInfo, error) {
+	fd, err := unix.Openat(dir, name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	return f.Stat()
+}
+
+// 从Root开始用openat逐级打开FTP路径中的目录, 每一级都不跟随符号链接. 遇到符号链接时先检查目标,
+// 再从目标所在的允许目录重新打开, 所以检查之后路径被替换成符号链接也不会访问到允许的目录之外.
+// 最后一级由fn在其所在的目录中操作, fn失败且最后一级是符号链接时, followLast为true则跟随后重试.
+// followLast为false时不跟随最后一级的符号链接, 用于删除、重命名等作用于链接本身的操作
+func (fs *LocalFileSystem) walk(path string, followLast bool, fn func(dir int, name string) error) error {
+	root, err := fs.rootDir()
+	if err != nil {
+		return err
+	}
+	names := splitLocalPath(path)
+	if len(names) == 0 && !followLast {
+		// 不允许删除或重命名根目录本身
+		return os.ErrPermission
+	}
+
+	dir, err := openDirAt(unix.AT_FDCWD, root)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = unix.Close(dir)
+	}()
+
+	current := root
+	follows := 0
+	for {
+		if len(names) == 0 {
+			// 根目录或指向允许目录本身的符号链接
+			return fn(dir, ".")
+		}
+		name := names[0]
+		names = names[1:]
+
+		if len(names) == 0 {
+			err = fn(dir, name)
+			if err == nil || !followLast {
+				return err
+			}
+		} else {
+			var next int
+			if next, err = openDirAt(dir, name); err == nil {
+				_ = unix.Close(dir)
+				dir, current = next, filepath.Join(current, name)
+				continue
+			}
+		}
+
+		// 失败的原因不是符号链接时返回原来的错误
+		if info, lerr := lstatAt(dir, name); lerr != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+
+		if fs.Symlinks == SymlinkNeverFollow {
+			return errSymlinkNotAllowed
+		}
+		if follows++; follows > maxSymlinkFollows {
+			return errSymlinkLoop
+		}
+		target, err := readlinkAt(dir, name)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(current, target)
+		}
+		target = filepath.Clean(target)
+
+		// 从链接目标所在的允许目录开始继续解析剩余的路径
+		base := fs.allowedBase(root, target)
+		if base == "" {
+			return errSymlinkNotAllowed
+		}
+		rel, err := filepath.Rel(base, target)
+		if err != nil {
+			return err
+		}
+		next, err := openDirAt(unix.AT_FDCWD, base)
+		if err != nil {
+			return err
+		}
+		_ = unix.Close(dir)
+		dir, current = next, base
+		names = append(splitLocalPath(filepath.ToSlash(rel)), names...)
+	}
+}
+
+// 最后一级是符号链接时返回 unix.ELOOP, 由 walk 跟随
+func statAt(dir int, name string) (os.FileInfo, error) {
+	info, err := lstatAt(dir, name)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return nil, unix.ELOOP
+	}
+	return info, err
+}
+
+// 在dir中打开name, O_NOFOLLOW 保证不会打开检查之后才出现的符号链接
+func openAt(dir int, name string, flag int) (*os.File, error) {
+	fd, err := unix.Openat(dir, name, flag|unix.O_NOFOLLOW|unix.O_CLOEXEC, uint32(os.ModePerm))
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func (fs *LocalFileSystem) Stat(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := fs.walk(path, true, func(dir int, name string) (err error) {
+		info, err = statAt(dir, name)
+		return err
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return info, nil
+}
+
+func (fs *LocalFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	var list []os.FileInfo
+	err := fs.walk(path, true, func(dir int, name string) error {
+		fd, err := openDirAt(dir, name)
+		if err != nil {
+			return err
+		}
+		f := os.NewFile(uintptr(fd), name)
+		defer f.Close()
+
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			return err
+		}
+		list = make([]os.FileInfo, 0, len(names))
+		for _, name := range names {
+			info, err := lstatAt(fd, name)
+			if os.IsNotExist(err) {
+				// 列目录期间被删除
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			list = append(list, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// 打开文件, 最后一级是符号链接时由 walk 跟随
+func (fs *LocalFileSystem) openFile(op, path string, flag int) (*os.File, error) {
+	var f *os.File
+	err := fs.walk(path, true, func(dir int, name string) (err error) {
+		f, err = openAt(dir, name, flag)
+		return err
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return f, nil
+}
+
+func (fs *LocalFileSystem) Open(path string, offset int64) (io.ReadCloser, error) {
+	f, err := fs.openFile("open", path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (fs *LocalFileSystem) Create(path string, offset int64) (io.WriteCloser, error) {
+	flag := os.O_CREATE | os.O_WRONLY
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	f, err := fs.openFile("create", path, flag)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// O_EXCL 不跟随符号链接, 所以最后一级也不跟随
+func (fs *LocalFileSystem) CreateNew(path string) (io.WriteCloser, error) {
+	var f *os.File
+	err := fs.walk(path, false, func(dir int, name string) (err error) {
+		f, err = openAt(dir, name, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+		return err
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+	return f, nil
+}
+
+func (fs *LocalFileSystem) Append(path string) (io.WriteCloser, error) {
+	return fs.openFile("append", path, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+}
+
+func (fs *LocalFileSystem) Remove(path string) error {
+	err := fs.walk(path, false, func(dir int, name string) error {
+		// 与 os.Remove 相同, 先按文件删除, 失败后再按目录删除
+		err := unix.Unlinkat(dir, name, 0)
+		if err == nil {
+			return nil
+		}
+		err1 := unix.Unlinkat(dir, name, unix.AT_REMOVEDIR)
+		if err1 == nil {
+			return nil
+		}
+		if err1 != unix.ENOTDIR {
+			err = err1
+		}
+		return err
+	})
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (fs *LocalFileSystem) Rename(from, to string) error {
+	err := fs.walk(from, false, func(fromDir int, fromName string) error {
+		return fs.walk(to, false, func(toDir int, toName string) error {
+			return unix.Renameat(fromDir, fromName, toDir, toName)
+		})
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	return nil
+}
+
+func (fs *LocalFileSystem) Mkdir(path string) error {
+	err := fs.walk(path, false, func(dir int, name string) error {
+		return unix.Mkdirat(dir, name, uint32(os.ModePerm))
+	})
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return nil
+}
+
+func (fs *LocalFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	ts := []unix.Timespec{unix.NsecToTimespec(atime.UnixNano()), unix.NsecToTimespec(mtime.UnixNano())}
+	err := fs.walk(path, true, func(dir int, name string) error {
+		if _, err := statAt(dir, name); err != nil {
+			return err
+		}
+		return unix.UtimesNanoAt(dir, name, ts, unix.AT_SYMLINK_NOFOLLOW)
+	})
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: path, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+//go:build !linux
+// +build !linux
+
+package ftpd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Linux以外的平台按路径解析符号链接, 打开文件后再确认一次. Linux上的实现见 filesystem_linux.go
+
+// 解析FTP路径对应的本地路径, 逐级检查符号链接. followLast为false时不跟随最后一级的符号链接,
+// 用于删除、重命名等作用于链接本身的操作
+func (fs *LocalFileSystem) realPath(path string, followLast bool) (string, error) {
+	root, err := fs.rootDir()
+	if err != nil {
+		return "", err
+	}
+
+	current := root
+	names := splitLocalPath(path)
+	if len(names) == 0 && !followLast {
+		// 不允许删除或重命名根目录本身
+		return "", os.ErrPermission
+	}
+
+	follows := 0
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+
+		next := filepath.Join(current, name)
+		if len(names) == 0 && !followLast {
+			return next, nil
+		}
+
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			// 不存在的路径中不会再有符号链接
+			return filepath.Join(append([]string{next}, names...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+
+		if fs.Symlinks == SymlinkNeverFollow {
+			return "", errSymlinkNotAllowed
+		}
+		if follows++; follows > maxSymlinkFollows {
+			return "", errSymlinkLoop
+		}
+
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(current, target)
+		}
+		target = filepath.Clean(target)
+
+		// 从链接目标所在的允许目录开始继续解析剩余的路径
+		base := fs.allowedBase(root, target)
+		if base == "" {
+			return "", errSymlinkNotAllowed
+		}
+		rel, err := filepath.Rel(base, target)
+		if err != nil {
+			return "", err
+		}
+		current = base
+		names = append(splitLocalPath(filepath.ToSlash(rel)), names...)
+	}
+	return current, nil
+}
+
+func (fs *LocalFileSystem) Stat(path string) (os.FileInfo, error) {
+	p, err := fs.realPath(path, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return os.Stat(p)
+}
+
+func (fs *LocalFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	p, err := fs.realPath(path, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	return ioutil.ReadDir(p)
+}
+
+func (fs *LocalFileSystem) Open(path string, offset int64) (io.ReadCloser, error) {
+	p, err := fs.realPath(path, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	f, err := openChecked(p, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (fs *LocalFileSystem) Create(path string, offset int64) (io.WriteCloser, error) {
+	p, err := fs.realPath(path, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+
+	flag := os.O_CREATE | os.O_WRONLY
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+
+	f, err := openChecked(p, flag)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (fs *LocalFileSystem) CreateNew(path string) (io.WriteCloser, error) {
+	p, err := fs.realPath(path, false)
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: err}
+	}
+	return openChecked(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+}
+
+func (fs *LocalFileSystem) Append(path string) (io.WriteCloser, error) {
+	p, err := fs.realPath(path, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "append", Path: path, Err: err}
+	}
+	return openChecked(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY)
+}
+
+// 打开realPath解析出的文件, 打开后再次确认最后一级没有在检查之后被替换成符号链接
+func openChecked(p string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(p, flag, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		var linfo os.FileInfo
+		if linfo, err = os.Lstat(p); err == nil && !os.SameFile(info, linfo) {
+			err = &os.PathError{Op: "open", Path: p, Err: errSymlinkNotAllowed}
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (fs *LocalFileSystem) Remove(path string) error {
+	p, err := fs.realPath(path, false)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	return os.Remove(p)
+}
+
+func (fs *LocalFileSystem) Rename(from, to string) error {
+	src, err := fs.realPath(from, false)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	dst, err := fs.realPath(to, false)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	return os.Rename(src, dst)
+}
+
+func (fs *LocalFileSystem) Mkdir(path string) error {
+	p, err := fs.realPath(path, false)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return os.Mkdir(p, os.ModePerm)
+}
+
+func (fs *LocalFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	p, err := fs.realPath(path, true)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: path, Err: err}
+	}
+	return os.Chtimes(p, atime, mtime)
+}
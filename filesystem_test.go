@@ -0,0 +1,120 @@
+//go:build !windows
+// +build !windows
+
+package ftpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalFileSystemSymlinks(t *testing.T) {
+	base, err := ioutil.TempDir("", "ftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.RemoveAll(base)
+	}()
+
+	home := filepath.Join(base, "home")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{home, filepath.Join(home, "data"), outside} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, "data", "in.txt"), []byte("inside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	links := map[string]string{
+		"inner":     "data",
+		"inner.txt": "data/in.txt",
+		"escape":    outside,
+		"relative":  "../outside",
+		"chain":     "relative",
+		"loop":      "loop",
+		"dangling":  filepath.Join(outside, "new.txt"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(home, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := NewLocalFileSystem(home)
+	if got := readMemFile(t, fs, "/inner/in.txt", 0); got != "inside" {
+		t.Fatalf("read through inner link = %q", got)
+	}
+	if got := readMemFile(t, fs, "/inner.txt", 2); got != "side" {
+		t.Fatalf("read inner file link = %q", got)
+	}
+	for _, path := range []string{"/escape/secret.txt", "/relative/secret.txt", "/chain/secret.txt", "/loop/x"} {
+		if _, err := fs.Open(path, 0); err == nil {
+			t.Fatalf("open %s should be denied", path)
+		}
+		if _, err := fs.Create(path, 0); err == nil {
+			t.Fatalf("create %s should be denied", path)
+		}
+	}
+
+	// 不能通过符号链接在根目录外创建文件或目录
+	if _, err := fs.Create("/dangling", 0); err == nil {
+		t.Fatal("create through dangling link should be denied")
+	}
+	if err := fs.Mkdir("/escape/dir"); err == nil {
+		t.Fatal("mkdir through escaping link should be denied")
+	}
+	if err := fs.Rename("/data/in.txt", "/relative/in.txt"); err == nil {
+		t.Fatal("rename through escaping link should be denied")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "new.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file created outside root: %v", err)
+	}
+
+	if _, err := fs.CreateNew("/data/in.txt"); !os.IsExist(err) {
+		t.Fatalf("create existing file: %v", err)
+	}
+	if _, err := fs.CreateNew("/inner.txt"); !os.IsExist(err) {
+		t.Fatalf("create over symlink: %v", err)
+	}
+
+	// 列目录时符号链接显示为链接本身
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 8 || infos[0].Name() != "chain" || infos[0].Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("ReadDir = %v", infos)
+	}
+
+	// 删除符号链接只删除链接本身
+	if err := fs.Remove("/escape"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret.txt")); err != nil {
+		t.Fatalf("link target removed: %v", err)
+	}
+	if err := fs.Remove("/"); err == nil {
+		t.Fatal("removing the root should be denied")
+	}
+
+	never := &LocalFileSystem{Root: home, Symlinks: SymlinkNeverFollow}
+	if _, err := never.Stat("/inner/in.txt"); err == nil {
+		t.Fatal("never policy followed a link")
+	}
+	if _, err := never.Stat("/data/in.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	allow := &LocalFileSystem{Root: home, Symlinks: SymlinkAllowTargets, SymlinkTargets: []string{outside}}
+	if got := readMemFile(t, allow, "/chain/secret.txt", 0); got != "secret" {
+		t.Fatalf("read through allowed target = %q", got)
+	}
+}
@@ -3,9 +3,9 @@ package ftpd
 import (
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,6 +15,11 @@ var (
 	owner      = "user"
 	group      = "group"
 	timePatten = "Jan _2 15:04"
+
+	// MLST/MLSD 支持的事实, 默认全部返回
+	mlstFacts = []string{"type", "size", "modify", "perm", "unique", "UNIX.mode", "UNIX.owner", "UNIX.group"}
+	// RFC 3659 规定的时间格式, 使用UTC时间
+	mlstTimePatten = "20060102150405"
 )
 
 type FtpFile interface {
@@ -64,6 +69,152 @@ func (l listFileFormater) format(fs []os.FileInfo) []byte {
 	return buf.Bytes()
 }
 
+// MDTM 返回的时间, 毫秒不为0时带上 .sss
+func formatModifyTime(t time.Time) string {
+	t = t.UTC()
+	if ms := t.Nanosecond() / int(time.Millisecond); ms != 0 {
+		return fmt.Sprintf("%s.%03d", t.Format(mlstTimePatten), ms)
+	}
+	return t.Format(mlstTimePatten)
+}
+
+// 解析 YYYYMMDDHHMMSS[.sss] 格式的UTC时间
+func parseModifyTime(value string) (time.Time, error) {
+	fraction := ""
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		value, fraction = value[:i], value[i+1:]
+	}
+	if len(value) != len(mlstTimePatten) {
+		return time.Time{}, ErrTimeFormat
+	}
+
+	t, err := time.ParseInLocation(mlstTimePatten, value, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if fraction != "" {
+		if len(fraction) > 9 {
+			return time.Time{}, ErrTimeFormat
+		}
+		ns, err := strconv.Atoi((fraction + "000000000")[:9])
+		if err != nil || ns < 0 {
+			return time.Time{}, ErrTimeFormat
+		}
+		t = t.Add(time.Duration(ns))
+	}
+	return t, nil
+}
+
+// RFC 3659 MLST/MLSD 格式, 每行由 "fact=value;" 组成的事实列表、空格和文件名构成
+type mlsdFileFormater struct {
+	facts []string
+}
+
+func (l mlsdFileFormater) format(fs []os.FileInfo) []byte {
+	var buf bytes.Buffer
+	for _, f := range fs {
+		buf.WriteString(l.formatFacts(f))
+		buf.WriteString(delim)
+		buf.WriteString(f.Name())
+		buf.WriteString(newline)
+	}
+	return buf.Bytes()
+}
+
+func (l mlsdFileFormater) formatFacts(f os.FileInfo) string {
+	var buf bytes.Buffer
+	for _, fact := range l.facts {
+		value := ""
+		switch fact {
+		case "type":
+			value = "file"
+			if f.IsDir() {
+				value = "dir"
+			}
+		case "size":
+			if !f.IsDir() {
+				value = strconv.FormatInt(f.Size(), 10)
+			}
+		case "modify":
+			value = formatTime(f.ModTime().UTC(), mlstTimePatten)
+		case "perm":
+			value = formatPerm(f)
+		case "unique":
+			value = fileUnique(f)
+		case "UNIX.mode":
+			value = fmt.Sprintf("%04o", f.Mode().Perm())
+		case "UNIX.owner":
+			value, _ = fileOwner(f)
+		case "UNIX.group":
+			_, value = fileOwner(f)
+		}
+		if value != "" {
+			buf.WriteString(fact)
+			buf.WriteString("=")
+			buf.WriteString(value)
+			buf.WriteString(";")
+		}
+	}
+	return buf.String()
+}
+
+// 根据文件所有者的权限位生成 perm 事实
+func formatPerm(f os.FileInfo) string {
+	mode := f.Mode().Perm()
+	perm := ""
+	if f.IsDir() {
+		if mode&0100 != 0 {
+			perm += "e"
+		}
+		if mode&0400 != 0 {
+			perm += "l"
+		}
+		if mode&0200 != 0 {
+			perm += "cdfmp"
+		}
+		return perm
+	}
+
+	if mode&0400 != 0 {
+		perm += "r"
+	}
+	if mode&0200 != 0 {
+		perm += "adfw"
+	}
+	return perm
+}
+
+// 解析 OPTS MLST 的参数, 按固定顺序返回选中的事实, 不支持的事实会被忽略
+func parseMlstFacts(arg string) []string {
+	var facts []string
+	for _, fact := range mlstFacts {
+		for _, name := range strings.Split(arg, ";") {
+			if strings.EqualFold(name, fact) {
+				facts = append(facts, fact)
+				break
+			}
+		}
+	}
+	return facts
+}
+
+// FEAT 中 MLST 的描述, 当前选中的事实以 '*' 标记
+func mlstFeature(selected []string) string {
+	var buf bytes.Buffer
+	buf.WriteString("MLST ")
+	for _, fact := range mlstFacts {
+		buf.WriteString(fact)
+		for _, s := range selected {
+			if s == fact {
+				buf.WriteString("*")
+			}
+		}
+		buf.WriteString(";")
+	}
+	return buf.String()
+}
+
 func formatSize(sz int64) string {
 	str := "            "
 	size := strconv.FormatInt(sz, 10)
@@ -74,20 +225,20 @@ func formatSize(sz int64) string {
 	return str[0:len(str)-len(size)] + size
 }
 
-func getFileList(path string, f FileFormater) ([]byte, error) {
-	info, err := os.Stat(path)
+func getFileList(fs FileSystem, path string, f FileFormater) ([]byte, error) {
+	info, err := fs.Stat(path)
 	if err != nil {
 		return nil, err
 	}
 
 	if !info.IsDir() {
-		fs := []os.FileInfo{info}
-		return f.format(fs), nil
+		files := []os.FileInfo{info}
+		return f.format(files), nil
 	} else {
-		fs, err := ioutil.ReadDir(path)
+		files, err := fs.ReadDir(path)
 		if err != nil {
 			return nil, err
 		}
-		return f.format(fs), nil
+		return f.format(files), nil
 	}
 }
@@ -1,3 +1,10 @@
 module github.com/zzustu/ftpd
 
 go 1.14
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.12
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
+	gopkg.in/yaml.v2 v2.3.0
+)
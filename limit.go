@@ -0,0 +1,85 @@
+package ftpd
+
+import (
+	"net"
+	"time"
+)
+
+// 连接频率限制未设置时间窗口时使用的默认值
+var defaultConnectionRateWindow = time.Minute
+
+// 拒绝连接时设置的写超时, 避免慢速客户端阻塞
+var rejectTimeout = 5 * time.Second
+
+// 连接的来源IP
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// 检查新连接是否超过连接数和连接频率的限制, 调用者需要持有 s.mutex
+func (s *FtpServer) allowConnection(ip string, now time.Time) bool {
+	opt := s.opt
+
+	// 被拒绝的连接同样计入连接频率, 持续重试的客户端会一直被拒绝
+	if opt.MaxConnectionsPerIP > 0 {
+		window := opt.ConnectionRateWindow
+		if window <= 0 {
+			window = defaultConnectionRateWindow
+		}
+		if s.recordConnection(ip, now, window) > opt.MaxConnectionsPerIP {
+			return false
+		}
+	}
+
+	if opt.MaxSessions > 0 && len(s.sessions) >= opt.MaxSessions {
+		return false
+	}
+	if opt.MaxSessionsPerIP > 0 && s.ipSessions[ip] >= opt.MaxSessionsPerIP {
+		return false
+	}
+	return true
+}
+
+// 记录一次连接, 返回时间窗口内该IP的连接次数
+func (s *FtpServer) recordConnection(ip string, now time.Time, window time.Duration) int {
+	if s.connections == nil {
+		s.connections = make(map[string][]time.Time)
+	}
+
+	// 每个时间窗口清理一次所有过期的记录, 防止map无限增长
+	if now.Sub(s.connectionsSweepAt) > window {
+		for k, times := range s.connections {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) > window {
+				delete(s.connections, k)
+			}
+		}
+		s.connectionsSweepAt = now
+	}
+
+	times := s.connections[ip]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > window {
+		i++
+	}
+	times = append(times[i:], now)
+	s.connections[ip] = times
+	return len(times)
+}
+
+// 向客户端发送421后关闭连接
+func (s *FtpServer) reject(conn net.Conn, message string) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		_ = conn.SetDeadline(time.Now().Add(rejectTimeout))
+		_, _ = conn.Write([]byte(NewFtpReply(reply421ServiceNotAvailableClosingControlConnection, message).String()))
+		_ = conn.Close()
+	}()
+}
@@ -0,0 +1,335 @@
+package ftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errDirNotEmpty = errors.New("directory not empty")
+	errIsDir       = errors.New("is a directory")
+	errNotDir      = errors.New("not a directory")
+)
+
+// MemFileSystem 是完全保存在内存中的文件系统, 用于测试或无需落盘的临时上传目录
+type MemFileSystem struct {
+	mutex sync.RWMutex
+	root  *memNode
+}
+
+type memNode struct {
+	name     string
+	dir      bool
+	data     []byte
+	modTime  time.Time
+	children map[string]*memNode
+}
+
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		root: &memNode{
+			name:     "/",
+			dir:      true,
+			modTime:  time.Now(),
+			children: make(map[string]*memNode),
+		},
+	}
+}
+
+// 将路径拆分为父目录和文件名, 根目录的文件名为空
+func splitMemPath(path string) (string, string) {
+	path = pathpkg.Clean("/" + path)
+	if path == "/" {
+		return "/", ""
+	}
+	return pathpkg.Split(path)
+}
+
+// 调用者需要持有锁
+func (fs *MemFileSystem) lookup(path string) (*memNode, error) {
+	node := fs.root
+	for _, name := range strings.Split(pathpkg.Clean("/"+path), "/") {
+		if name == "" {
+			continue
+		}
+		if !node.dir {
+			return nil, errNotDir
+		}
+		child, ok := node.children[name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// 查找父目录, 调用者需要持有锁
+func (fs *MemFileSystem) lookupParent(path string) (*memNode, string, error) {
+	dir, name := splitMemPath(path)
+	if name == "" {
+		return nil, "", os.ErrInvalid
+	}
+	parent, err := fs.lookup(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.dir {
+		return nil, "", errNotDir
+	}
+	return parent, name, nil
+}
+
+func (fs *MemFileSystem) Stat(path string) (os.FileInfo, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	node, err := fs.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	return node.info(), nil
+}
+
+func (fs *MemFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	node, err := fs.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+	}
+	if !node.dir {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: errNotDir}
+	}
+
+	files := make([]os.FileInfo, 0, len(node.children))
+	for _, child := range node.children {
+		files = append(files, child.info())
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files, nil
+}
+
+func (fs *MemFileSystem) Open(path string, offset int64) (io.ReadCloser, error) {
+	fs.mutex.RLock()
+	defer fs.mutex.RUnlock()
+
+	node, err := fs.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	if node.dir {
+		return nil, &os.PathError{Op: "open", Path: path, Err: errIsDir}
+	}
+	return &memFile{fs: fs, node: node, offset: offset}, nil
+}
+
+func (fs *MemFileSystem) Create(path string, offset int64) (io.WriteCloser, error) {
+	return fs.openWrite("create", path, offset, false, false)
+}
+
+func (fs *MemFileSystem) CreateNew(path string) (io.WriteCloser, error) {
+	return fs.openWrite("create", path, 0, false, true)
+}
+
+func (fs *MemFileSystem) Append(path string) (io.WriteCloser, error) {
+	return fs.openWrite("append", path, 0, true, false)
+}
+
+func (fs *MemFileSystem) openWrite(op, path string, offset int64, append, exclusive bool) (io.WriteCloser, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	parent, name, err := fs.lookupParent(path)
+	if err != nil {
+		return nil, &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	node, ok := parent.children[name]
+	if !ok {
+		node = &memNode{name: name, modTime: time.Now()}
+		parent.children[name] = node
+	} else if exclusive {
+		return nil, &os.PathError{Op: op, Path: path, Err: os.ErrExist}
+	} else if node.dir {
+		return nil, &os.PathError{Op: op, Path: path, Err: errIsDir}
+	}
+
+	if !append && offset == 0 {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{fs: fs, node: node, offset: offset, append: append}, nil
+}
+
+func (fs *MemFileSystem) Remove(path string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	parent, name, err := fs.lookupParent(path)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	node, ok := parent.children[name]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	if node.dir && len(node.children) > 0 {
+		return &os.PathError{Op: "remove", Path: path, Err: errDirNotEmpty}
+	}
+
+	delete(parent.children, name)
+	parent.modTime = time.Now()
+	return nil
+}
+
+func (fs *MemFileSystem) Rename(from, to string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	fromParent, fromName, err := fs.lookupParent(from)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	node, ok := fromParent.children[fromName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrNotExist}
+	}
+
+	toParent, toName, err := fs.lookupParent(to)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+	}
+	if target, ok := toParent.children[toName]; ok && target != node {
+		if target.dir || node.dir {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrExist}
+		}
+	}
+
+	// 不允许将目录移动到它自己的子目录中
+	if node.dir {
+		src := pathpkg.Clean("/" + from)
+		dst := pathpkg.Clean("/" + to)
+		if strings.HasPrefix(dst, src+"/") {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrInvalid}
+		}
+	}
+
+	now := time.Now()
+	delete(fromParent.children, fromName)
+	node.name = toName
+	toParent.children[toName] = node
+	fromParent.modTime = now
+	toParent.modTime = now
+	return nil
+}
+
+func (fs *MemFileSystem) Mkdir(path string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	parent, name, err := fs.lookupParent(path)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	if _, ok := parent.children[name]; ok {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+
+	now := time.Now()
+	parent.children[name] = &memNode{
+		name:     name,
+		dir:      true,
+		modTime:  now,
+		children: make(map[string]*memNode),
+	}
+	parent.modTime = now
+	return nil
+}
+
+func (fs *MemFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	node, err := fs.lookup(path)
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: path, Err: err}
+	}
+	node.modTime = mtime
+	return nil
+}
+
+// 内存文件的读写句柄, 每次读写都在文件系统的锁内进行, 可以看到其他会话的修改
+type memFile struct {
+	fs     *MemFileSystem
+	node   *memNode
+	offset int64
+	append bool
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mutex.RLock()
+	defer f.fs.mutex.RUnlock()
+
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mutex.Lock()
+	defer f.fs.mutex.Unlock()
+
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+
+	end := f.offset + int64(len(b))
+	if end > int64(len(f.node.data)) {
+		// 容量按倍数增长, 大文件分块上传时总的复制量与文件大小成正比.
+		// 文件只会被截断为nil, 长度之外的部分总是0, 跳过的部分不需要再清零
+		if end > int64(cap(f.node.data)) {
+			size := 2 * int64(cap(f.node.data))
+			if size < end {
+				size = end
+			}
+			data := make([]byte, len(f.node.data), size)
+			copy(data, f.node.data)
+			f.node.data = data
+		}
+		f.node.data = f.node.data[:end]
+	}
+	copy(f.node.data[f.offset:], b)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(b), nil
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (node *memNode) info() os.FileInfo {
+	mode := os.FileMode(0644)
+	if node.dir {
+		mode = os.ModeDir | 0755
+	}
+	return &fileInfo{
+		name:    node.name,
+		size:    int64(len(node.data)),
+		mode:    mode,
+		modTime: node.modTime,
+	}
+}
@@ -0,0 +1,167 @@
+package ftpd
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeMemFile(t *testing.T, fs FileSystem, path, content string) {
+	t.Helper()
+	w, err := fs.Create(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readMemFile(t *testing.T, fs FileSystem, path string, offset int64) string {
+	t.Helper()
+	r, err := fs.Open(path, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMemFileSystemReadWrite(t *testing.T) {
+	fs := NewMemFileSystem()
+
+	writeMemFile(t, fs, "/a.txt", "hello world")
+	if got := readMemFile(t, fs, "/a.txt", 6); got != "world" {
+		t.Fatalf("read at offset = %q", got)
+	}
+
+	// 从偏移处写入不会清空原有内容
+	w, err := fs.Create("/a.txt", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("there"))
+	_ = w.Close()
+	if got := readMemFile(t, fs, "/a.txt", 0); got != "hello there" {
+		t.Fatalf("after offset write = %q", got)
+	}
+
+	w, err = fs.Append("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("!"))
+	_ = w.Close()
+	if got := readMemFile(t, fs, "/a.txt", 0); got != "hello there!" {
+		t.Fatalf("after append = %q", got)
+	}
+
+	writeMemFile(t, fs, "/a.txt", "new")
+	if info, err := fs.Stat("/a.txt"); err != nil || info.Size() != 3 {
+		t.Fatalf("after truncate: %v %v", info, err)
+	}
+	// 跳过的部分为0
+	if w, err = fs.Create("/a.txt", 5); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("!"))
+	_ = w.Close()
+	if got := readMemFile(t, fs, "/a.txt", 0); got != "new\x00\x00!" {
+		t.Fatalf("after write past end = %q", got)
+	}
+
+	// 分块写入大文件
+	if w, err = fs.Create("/big", 0); err != nil {
+		t.Fatal(err)
+	}
+	chunk := []byte(strings.Repeat("0123456789abcdef", 2048))
+	for i := 0; i < 256; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = w.Close()
+	if got := readMemFile(t, fs, "/big", int64(255*len(chunk))); got != string(chunk) {
+		t.Fatalf("last chunk = %d bytes", len(got))
+	}
+
+	// 独占创建不会覆盖已有文件
+	if _, err := fs.CreateNew("/a.txt"); !os.IsExist(err) {
+		t.Fatalf("create existing file: %v", err)
+	}
+	if w, err := fs.CreateNew("/b.txt"); err != nil {
+		t.Fatal(err)
+	} else {
+		_ = w.Close()
+	}
+
+	if _, err := fs.Open("/missing", 0); !os.IsNotExist(err) {
+		t.Fatalf("open missing file: %v", err)
+	}
+	if _, err := fs.Open("/", 0); err == nil {
+		t.Fatal("open directory should fail")
+	}
+}
+
+func TestMemFileSystemDirectories(t *testing.T) {
+	fs := NewMemFileSystem()
+
+	if err := fs.Mkdir("/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/d"); !os.IsExist(err) {
+		t.Fatalf("mkdir twice: %v", err)
+	}
+	if err := fs.Mkdir("/x/y"); !os.IsNotExist(err) {
+		t.Fatalf("mkdir without parent: %v", err)
+	}
+
+	writeMemFile(t, fs, "/d/b.txt", "b")
+	writeMemFile(t, fs, "/d/a.txt", "a")
+
+	files, err := fs.ReadDir("/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name() != "a.txt" || files[1].Name() != "b.txt" {
+		t.Fatalf("readdir = %v", files)
+	}
+
+	if err := fs.Remove("/d"); err == nil {
+		t.Fatal("remove non-empty directory should fail")
+	}
+	if err := fs.Rename("/d", "/d/e"); err == nil {
+		t.Fatal("rename directory into itself should fail")
+	}
+	if err := fs.Rename("/d/a.txt", "/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMemFile(t, fs, "/c.txt", 0); got != "a" {
+		t.Fatalf("renamed file = %q", got)
+	}
+	if err := fs.Rename("/d", "/e"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := fs.Stat("/e/b.txt"); err != nil || info.Name() != "b.txt" {
+		t.Fatalf("stat after directory rename: %v %v", info, err)
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := fs.Chtimes("/c.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := fs.Stat("/c.txt"); !info.ModTime().Equal(mtime) {
+		t.Fatalf("mod time = %s", info.ModTime())
+	}
+}
@@ -8,9 +8,27 @@ import (
 	"strings"
 )
 
+const (
+	netProtocolIPv4 = "1"
+	netProtocolIPv6 = "2"
+)
+
 var (
 	ErrSocketFormat = errors.New("socket format error")
+	ErrNetProtocol  = errors.New("network protocol not supported")
+	ErrTimeFormat   = errors.New("time format error")
 	ErrServerClosed = errors.New("FTP Server Closed")
+
+	ErrTLSNotConfigured = errors.New("TLS config is required for implicit FTPS")
+	ErrGroupQuotaRoot   = errors.New("group quota requires Root or FileSystem")
+	ErrAnonymousRoot    = errors.New("anonymous login requires Root or FileSystem")
+
+	ErrDataConnClosed      = errors.New("data connection closed")
+	ErrPasvPortUnavailable = errors.New("no passive port available")
+
+	ErrAuthenticationFailed = errors.New("authentication failed")
+	ErrUnsupportedHash      = errors.New("unsupported password hash")
+	ErrNoHomeDir            = errors.New("user has no home directory")
 )
 
 type FtpUser struct {
@@ -18,6 +36,27 @@ type FtpUser struct {
 	Password   string
 	HomeDir    string
 	currentDir string
+
+	// 用户使用的文件系统, 为nil时使用以HomeDir为根目录的本地文件系统
+	FileSystem FileSystem
+	// 使用本地文件系统时对符号链接的处理策略
+	SymlinkPolicy  SymlinkPolicy
+	SymlinkTargets []string
+
+	// 用户的操作权限. PermissionsSet 为false且 Permissions 为0时拥有全部权限,
+	// 为true时 Permissions 为0表示没有任何权限
+	Permissions    Permission
+	PermissionsSet bool
+	// 子路径(FTP路径)上的权限, 覆盖 Permissions, 按最长前缀匹配
+	PathPermissions map[string]Permission
+
+	// 用户所属的组, FtpServerOpt.GroupQuotas 中有该组的配额时同组用户共享配额
+	Group string
+	// 用户的配额, 为nil时不限制. 所属的组有配额时使用组的配额
+	Quota *Quota
+
+	// 是否是匿名登录的用户
+	Anonymous bool
 }
 
 type FtpUserManager interface {
@@ -61,5 +100,56 @@ func decoderSocket(arg string) (*net.TCPAddr, error) {
 	return addr, err
 }
 
-func encoderSocket(session FtpSession) {
+func decoderExtendedSocket(arg string) (*net.TCPAddr, error) {
+	// |1|127.0.0.1|12999| 或 |2|::1|12999|, 分隔符可以是任意可打印字符
+	if len(arg) < 2 {
+		return nil, ErrSocketFormat
+	}
+	args := strings.Split(arg, arg[:1])
+	if len(args) != 5 || args[0] != "" || args[4] != "" {
+		return nil, ErrSocketFormat
+	}
+
+	ip := net.ParseIP(args[2])
+	if ip == nil {
+		return nil, ErrSocketFormat
+	}
+
+	switch args[1] {
+	case netProtocolIPv4:
+		if ip.To4() == nil {
+			return nil, ErrSocketFormat
+		}
+	case netProtocolIPv6:
+		if ip.To4() != nil {
+			return nil, ErrSocketFormat
+		}
+	default:
+		return nil, ErrNetProtocol
+	}
+
+	port, err := strconv.Atoi(args[3])
+	if err != nil || port <= 0 || port > 0xffff {
+		return nil, ErrSocketFormat
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// 返回地址对应的RFC 2428网络协议编号, IPv4为1, IPv6为2
+func netProtocol(ip net.IP) string {
+	if ip.To4() != nil {
+		return netProtocolIPv4
+	}
+	return netProtocolIPv6
+}
+
+func encoderSocket(addr *net.TCPAddr) (string, error) {
+	// 12999 127.0.0.1 => 127,0,0,1,50,199
+	ipv4 := addr.IP.To4()
+	if ipv4 == nil || addr.Port < 0 || addr.Port > 0xffff {
+		return "", ErrSocketFormat
+	}
+
+	return fmt.Sprintf("%d,%d,%d,%d,%d,%d", ipv4[0], ipv4[1], ipv4[2], ipv4[3], addr.Port>>8, addr.Port&0xff), nil
 }
@@ -0,0 +1,352 @@
+package ftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 用户不存在时用于比较的bcrypt哈希, 使不存在的用户和密码错误的用户耗时相同
+const dummyPasswordHash = "$2a$10$z8CTxc3v/jlOrpDabLxcYOiovq.2XAVJ2/HXi8Bm4bmKthMy1c5yy"
+
+// 检查哈希的格式是否支持
+func checkPasswordHash(hashed string) error {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hashed))
+		return err
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		_, _, _, err := parseArgon2id(hashed)
+		return err
+	case strings.HasPrefix(hashed, "$5$"):
+		return checkCrypt("$5$", hashed, 43)
+	case strings.HasPrefix(hashed, "$6$"):
+		return checkCrypt("$6$", hashed, 86)
+	case strings.HasPrefix(hashed, "$1$"):
+		return checkCrypt("$1$", hashed, 22)
+	case strings.HasPrefix(hashed, "$apr1$"):
+		return checkCrypt("$apr1$", hashed, 22)
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum, err := base64.StdEncoding.DecodeString(hashed[len("{SHA}"):])
+		if err != nil || len(sum) != sha1.Size {
+			return ErrUnsupportedHash
+		}
+		return nil
+	}
+	return ErrUnsupportedHash
+}
+
+// 检查 crypt(3) 格式的哈希: 盐不能为空, 哈希是 size 个 cryptAlphabet 中的字符, 只有SHA-crypt支持rounds参数
+func checkCrypt(magic, hashed string, size int) error {
+	rounds, salt, expected := splitCrypt(magic, hashed)
+	if magic == "$5$" || magic == "$6$" {
+		if _, err := shaCryptRounds(rounds); err != nil {
+			return err
+		}
+	} else if rounds != "" {
+		return ErrUnsupportedHash
+	}
+	if salt == "" || len(expected) != size {
+		return ErrUnsupportedHash
+	}
+	for i := 0; i < len(expected); i++ {
+		if strings.IndexByte(cryptAlphabet, expected[i]) < 0 {
+			return ErrUnsupportedHash
+		}
+	}
+	return nil
+}
+
+// 校验密码是否与哈希匹配, 比较的耗时与密码内容无关.
+// 支持 bcrypt($2a$, $2b$, $2y$), argon2id, SHA-crypt($5$, $6$), MD5-crypt($1$, $apr1$) 和 htpasswd 的 {SHA}
+func checkPassword(hashed, password string) (bool, error) {
+	var computed, expected string
+	var err error
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return err == nil, err
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return checkArgon2id(hashed, password)
+	case strings.HasPrefix(hashed, "$5$"):
+		computed, expected, err = shaCrypt(sha256.New, "$5$", hashed, password)
+	case strings.HasPrefix(hashed, "$6$"):
+		computed, expected, err = shaCrypt(sha512.New, "$6$", hashed, password)
+	case strings.HasPrefix(hashed, "$1$"):
+		computed, expected = md5Crypt("$1$", hashed, password)
+	case strings.HasPrefix(hashed, "$apr1$"):
+		computed, expected = md5Crypt("$apr1$", hashed, password)
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed, expected = base64.StdEncoding.EncodeToString(sum[:]), hashed[len("{SHA}"):]
+	default:
+		return false, ErrUnsupportedHash
+	}
+	if err != nil {
+		return false, err
+	}
+	if expected == "" {
+		return false, ErrUnsupportedHash
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(expected)) == 1, nil
+}
+
+// 解析 $argon2id$v=19$m=65536,t=3,p=4$salt$hash 格式的哈希
+func parseArgon2id(hashed string) (params [3]uint32, salt, key []byte, err error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params[0], &params[1], &params[2]); err != nil ||
+		params[1] == 0 || params[2] == 0 || params[2] > 0xff {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnsupportedHash
+	}
+	return params, salt, key, nil
+}
+
+func checkArgon2id(hashed, password string) (bool, error) {
+	params, salt, key, err := parseArgon2id(hashed)
+	if err != nil {
+		return false, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params[1], params[0], uint8(params[2]), uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// crypt(3) 使用的base64编码, 按 order 中的三元组编码, 每组先输出低位
+func cryptEncode(sum []byte, order [][3]int) string {
+	var b strings.Builder
+	for _, group := range order {
+		v, n := 0, 4
+		for i, idx := range group {
+			if idx < 0 {
+				// 最后一组不足3个字节
+				n--
+				continue
+			}
+			v |= int(sum[idx]) << uint(8*(2-i))
+		}
+		for ; n > 0; n-- {
+			b.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	return b.String()
+}
+
+// 拆分 magic[rounds=N$]salt$hash, 返回rounds参数(没有时为空)、盐和哈希
+func splitCrypt(magic, hashed string) (rounds, salt, expected string) {
+	rest := hashed[len(magic):]
+	if strings.HasPrefix(rest, "rounds=") {
+		if i := strings.IndexByte(rest, '$'); i >= 0 {
+			rounds, rest = rest[len("rounds="):i], rest[i+1:]
+		}
+	}
+	if i := strings.LastIndexByte(rest, '$'); i >= 0 {
+		salt, expected = rest[:i], rest[i+1:]
+	} else {
+		salt = rest
+	}
+	return rounds, salt, expected
+}
+
+var (
+	md5CryptOrder = [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}, {-1, -1, 11}}
+
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}, {-1, 31, 30},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+		{-1, -1, 63},
+	}
+)
+
+// MD5-crypt, $apr1$ 是Apache htpasswd使用的变体, 只有magic不同
+func md5Crypt(magic, hashed, password string) (string, string) {
+	_, salt, expected := splitCrypt(magic, hashed)
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic))
+	h.Write([]byte(salt))
+	for n := len(pw); n > 0; n -= 16 {
+		if n > 16 {
+			h.Write(altSum)
+		} else {
+			h.Write(altSum[:n])
+		}
+	}
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+	return cryptEncode(sum, md5CryptOrder), expected
+}
+
+// 重复src直到长度为n
+func repeatBytes(src []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, src[:min(len(src), n-len(out))]...)
+	}
+	return out
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// SHA-crypt的rounds参数, 为空时使用默认值5000, 超出范围时按规范取最接近的值
+func shaCryptRounds(arg string) (int, error) {
+	if arg == "" {
+		return 5000, nil
+	}
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, ErrUnsupportedHash
+	}
+	if n < 1000 {
+		n = 1000
+	} else if n > 999999999 {
+		n = 999999999
+	}
+	return n, nil
+}
+
+// SHA-crypt, 见 https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(newHash func() hash.Hash, magic, hashed, password string) (string, string, error) {
+	roundsArg, salt, expected := splitCrypt(magic, hashed)
+	rounds, err := shaCryptRounds(roundsArg)
+	if err != nil {
+		return "", "", err
+	}
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	pw, saltBytes := []byte(password), []byte(salt)
+
+	alt := newHash()
+	alt.Write(pw)
+	alt.Write(saltBytes)
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := newHash()
+	h.Write(pw)
+	h.Write(saltBytes)
+	h.Write(repeatBytes(altSum, len(pw)))
+	for n := len(pw); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(altSum)
+		} else {
+			h.Write(pw)
+		}
+	}
+	sum := h.Sum(nil)
+
+	dp := newHash()
+	for i := 0; i < len(pw); i++ {
+		dp.Write(pw)
+	}
+	p := repeatBytes(dp.Sum(nil), len(pw))
+
+	ds := newHash()
+	for i := 0; i < 16+int(sum[0]); i++ {
+		ds.Write(saltBytes)
+	}
+	s := repeatBytes(ds.Sum(nil), len(saltBytes))
+
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(p)
+		}
+		sum = h.Sum(nil)
+	}
+
+	order := sha256CryptOrder
+	if len(sum) == sha512.Size {
+		order = sha512CryptOrder
+	}
+	return cryptEncode(sum, order), expected, nil
+}
@@ -0,0 +1,94 @@
+package ftpd
+
+import (
+	"fmt"
+	pathpkg "path"
+	"strings"
+)
+
+// Permission 是用户对文件和目录的操作权限, 可以按位组合
+type Permission uint16
+
+const (
+	// 列出目录、切换目录和查看文件信息
+	PermList Permission = 1 << iota
+	// 下载文件和计算校验值
+	PermRead
+	// 上传文件(STOR, STOU)
+	PermWrite
+	// 追加内容(APPE)
+	PermAppend
+	PermDelete
+	PermRename
+	PermMkdir
+	PermRmdir
+	// 修改文件属性, 如 MFMT 修改修改时间
+	PermChmod
+
+	PermReadOnly = PermList | PermRead
+	PermAll      = PermList | PermRead | PermWrite | PermAppend | PermDelete | PermRename | PermMkdir | PermRmdir | PermChmod
+)
+
+// 用户在path上的权限. 子路径上设置的权限按最长前缀匹配覆盖用户的权限,
+// 用户没有设置任何权限时拥有全部权限
+func (u *FtpUser) permission(path string) Permission {
+	perm := u.Permissions
+	if perm == 0 && !u.PermissionsSet {
+		perm = PermAll
+	}
+
+	longest := -1
+	for dir, p := range u.PathPermissions {
+		dir = pathpkg.Clean("/" + dir)
+		if dir != "/" && path != dir && !strings.HasPrefix(path, dir+"/") {
+			continue
+		}
+		if len(dir) > longest {
+			longest = len(dir)
+			perm = p
+		}
+	}
+	return perm
+}
+
+// 检查当前用户在path上是否有perm权限, 没有时向客户端返回550
+func (session *FtpSession) checkPermission(perm Permission, path string) bool {
+	if session.FtpUser == nil || session.FtpUser.permission(path)&perm == perm {
+		return true
+	}
+	session.write(reply550RequestedActionNotTaken, "Permission denied.")
+	return false
+}
+
+var permissionNames = map[string]Permission{
+	"list":     PermList,
+	"read":     PermRead,
+	"write":    PermWrite,
+	"append":   PermAppend,
+	"delete":   PermDelete,
+	"rename":   PermRename,
+	"mkdir":    PermMkdir,
+	"rmdir":    PermRmdir,
+	"chmod":    PermChmod,
+	"readonly": PermReadOnly,
+	"all":      PermAll,
+	"none":     0,
+}
+
+// ParsePermission 解析以逗号分隔的权限名, 如 "list,read,write", 名称不区分大小写.
+// "none" 表示没有任何权限
+func ParsePermission(s string) (Permission, error) {
+	var perm Permission
+	for _, name := range strings.Split(s, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		p, ok := permissionNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		perm |= p
+	}
+	return perm, nil
+}
@@ -0,0 +1,302 @@
+package ftpd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	pathpkg "path"
+	"strings"
+	"sync"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaPolicy 决定上传超出配额时如何处理已写入的数据
+type QuotaPolicy int
+
+const (
+	// 删除本次上传新建(或覆盖)的文件, 追加和断点续传时保留原有内容和配额以内已写入的数据(默认)
+	QuotaRemovePartial QuotaPolicy = iota
+	// 保留配额以内已写入的数据
+	QuotaKeepPartial
+)
+
+// 解析配额策略, remove 或 keep, 为空时使用默认策略
+func parseQuotaPolicy(s string) (QuotaPolicy, error) {
+	switch strings.ToLower(s) {
+	case "", "remove":
+		return QuotaRemovePartial, nil
+	case "keep":
+		return QuotaKeepPartial, nil
+	}
+	return 0, fmt.Errorf("unknown quota policy %q", s)
+}
+
+// Quota 限制用户或组可以使用的空间和文件数, 为0的限制表示不限制
+type Quota struct {
+	MaxBytes int64
+	MaxFiles int64
+	Policy   QuotaPolicy
+}
+
+// GroupQuota 是同组用户共享的配额, 在 FtpServerOpt.GroupQuotas 中按组名设置.
+// 组内用户的文件需要都在同一个根目录下, 已有的使用量通过扫描这个根目录得到
+type GroupQuota struct {
+	Quota
+	// 组的根目录, FileSystem 为nil时使用以 Root 为根目录的本地文件系统
+	Root       string
+	FileSystem FileSystem
+}
+
+func (q *GroupQuota) fileSystem() FileSystem {
+	if q.FileSystem != nil {
+		return q.FileSystem
+	}
+	return NewLocalFileSystem(q.Root)
+}
+
+// 用户或组当前的使用量, 同一个用户(组)的所有会话共享
+type quotaUsage struct {
+	// 扫描已有文件完成后关闭, 修改使用量之前需要等待扫描完成
+	scanned chan struct{}
+	mutex   sync.Mutex
+	quota   Quota
+	bytes   int64
+	files   int64
+}
+
+func newQuotaUsage(fs FileSystem) *quotaUsage {
+	u := &quotaUsage{scanned: make(chan struct{})}
+	go func() {
+		defer close(u.scanned)
+		bytes, files := scanUsage(fs, "/")
+		u.mutex.Lock()
+		u.bytes, u.files = bytes, files
+		u.mutex.Unlock()
+	}()
+	return u
+}
+
+// 统计文件系统中已有文件的大小和数量
+func scanUsage(fs FileSystem, dir string) (bytes, files int64) {
+	list, err := fs.ReadDir(dir)
+	if err != nil {
+		log.Print(err)
+		return 0, 0
+	}
+	for _, f := range list {
+		if f.IsDir() {
+			b, n := scanUsage(fs, pathpkg.Join(dir, f.Name()))
+			bytes += b
+			files += n
+			continue
+		}
+		bytes += f.Size()
+		files++
+	}
+	return bytes, files
+}
+
+// 申请n个字节的空间, 返回实际可以使用的字节数
+func (u *quotaUsage) reserve(n int64) int64 {
+	<-u.scanned
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if max := u.quota.MaxBytes; max > 0 && u.bytes+n > max {
+		n = max - u.bytes
+		if n < 0 {
+			n = 0
+		}
+	}
+	u.bytes += n
+	return n
+}
+
+// 新增一个文件, 超出文件数限制时返回false
+func (u *quotaUsage) addFile() bool {
+	<-u.scanned
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.quota.MaxFiles > 0 && u.files >= u.quota.MaxFiles {
+		return false
+	}
+	u.files++
+	return true
+}
+
+func (u *quotaUsage) release(bytes, files int64) {
+	<-u.scanned
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	u.bytes -= bytes
+	u.files -= files
+	if u.bytes < 0 {
+		u.bytes = 0
+	}
+	if u.files < 0 {
+		u.files = 0
+	}
+}
+
+func (u *quotaUsage) usage() (Quota, int64, int64) {
+	<-u.scanned
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.quota, u.bytes, u.files
+}
+
+// 用户所属的组在 FtpServerOpt.GroupQuotas 中设置了配额时返回组的配额
+func (session *FtpSession) groupQuota() *GroupQuota {
+	if user := session.FtpUser; user != nil && user.Group != "" {
+		return session.FtpServer.opt.GroupQuotas[user.Group]
+	}
+	return nil
+}
+
+// 当前用户的配额使用量, 没有配额时返回nil. 组的配额优先于用户自己的配额.
+// 第一次使用时在后台扫描已有的文件, 登录时调用以便尽早开始扫描
+func (session *FtpSession) quotaUsage() *quotaUsage {
+	user := session.FtpUser
+	if user == nil {
+		return nil
+	}
+
+	var key string
+	var quota Quota
+	var fs FileSystem
+	if group := session.groupQuota(); group != nil {
+		key, quota, fs = "group:"+user.Group, group.Quota, group.fileSystem()
+	} else if user.Quota != nil {
+		// 用户的配额使用最近登录时的设置
+		key, quota, fs = "user:"+user.Username, *user.Quota, session.fileSystem()
+	} else {
+		return nil
+	}
+
+	s := session.FtpServer
+	s.mutex.Lock()
+	if s.quotas == nil {
+		s.quotas = make(map[string]*quotaUsage)
+	}
+	u := s.quotas[key]
+	if u == nil {
+		u = newQuotaUsage(fs)
+		s.quotas[key] = u
+	}
+	s.mutex.Unlock()
+
+	u.mutex.Lock()
+	u.quota = quota
+	u.mutex.Unlock()
+	return u
+}
+
+// 打开上传的文件并应用配额. flag 为 os.O_APPEND 时追加, 为 os.O_EXCL 时只创建新文件.
+// old 是上传前的文件信息, 文件不存在时为nil. 新建文件超出文件数限制时返回 errQuotaExceeded
+func (session *FtpSession) createUpload(path string, offset int64, flag int, old os.FileInfo) (io.WriteCloser, error) {
+	fs := session.fileSystem()
+	usage := session.quotaUsage()
+
+	// 新建文件占用一个文件数, 覆盖已有文件时原来的内容不再占用配额
+	appending := flag == os.O_APPEND
+	created := old == nil || (!appending && offset == 0)
+	if usage != nil && old == nil && !usage.addFile() {
+		return nil, errQuotaExceeded
+	}
+
+	var file io.WriteCloser
+	var err error
+	switch flag {
+	case os.O_APPEND:
+		file, err = fs.Append(path)
+	case os.O_EXCL:
+		file, err = fs.CreateNew(path)
+	default:
+		file, err = fs.Create(path, offset)
+	}
+	if err != nil {
+		if usage != nil && old == nil {
+			usage.release(0, 1)
+		}
+		return nil, err
+	}
+	if usage == nil {
+		return file, nil
+	}
+	if old != nil && created {
+		usage.release(old.Size(), 0)
+	}
+
+	w := &quotaWriter{WriteCloser: file, usage: usage, fs: fs, path: path, pos: offset, created: created}
+	if old != nil && !created {
+		w.size = old.Size()
+		if appending {
+			w.pos = w.size
+		}
+	}
+	return w, nil
+}
+
+// 写入时检查配额, 只计算文件增长的部分
+type quotaWriter struct {
+	io.WriteCloser
+	usage    *quotaUsage
+	fs       FileSystem
+	path     string
+	pos      int64
+	size     int64
+	created  bool
+	exceeded bool
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	grow := w.pos + int64(len(p)) - w.size
+	if grow < 0 {
+		grow = 0
+	}
+	allowed := w.usage.reserve(grow)
+	if allowed < grow {
+		// 只写入配额以内的部分
+		p = p[:int64(len(p))-(grow-allowed)]
+		w.exceeded = true
+	}
+
+	n, err := w.WriteCloser.Write(p)
+	w.pos += int64(n)
+
+	// 归还申请了但没有写入的部分
+	actual := w.pos - w.size
+	if actual < 0 {
+		actual = 0
+	}
+	w.usage.release(allowed-actual, 0)
+	if w.pos > w.size {
+		w.size = w.pos
+	}
+
+	if err == nil && w.exceeded {
+		err = errQuotaExceeded
+	}
+	return n, err
+}
+
+func (w *quotaWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if !w.exceeded || !w.created {
+		return err
+	}
+
+	if quota, _, _ := w.usage.usage(); quota.Policy == QuotaRemovePartial {
+		if rerr := w.fs.Remove(w.path); rerr != nil {
+			log.Print(rerr)
+		} else {
+			w.usage.release(w.size, 1)
+		}
+	}
+	return err
+}
@@ -1,5 +1,10 @@
 package ftpd
 
+import (
+	"strconv"
+	"strings"
+)
+
 const (
 	// 110 Restart marker reply. In this case, the text is exact and not left to
 	// the particular implementation; it must read: MARK yyyy = mmmm Where yyyy
@@ -55,12 +60,24 @@ const (
 	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2).
 	reply227EnteringPassiveMode = 227
 
+	// 229 Entering Extended Passive Mode (|||port|).
+	reply229EnteringExtendedPassiveMode = 229
+
 	// 230 User logged in, proceed.
 	reply230UserLoggedIn = 230
 
+	// 234 Security data exchange complete (AUTH TLS accepted).
+	reply234SecurityDataExchangeComplete = 234
+
 	// 250 Requested file action okay, completed.
 	reply250RequestedFileActionOkay = 250
 
+	// 251 MD5 checksum of a file (draft-twine-ftpmd5).
+	reply251FileChecksum = 251
+
+	// 252 MD5 checksums of multiple files (draft-twine-ftpmd5).
+	reply252FileChecksums = 252
+
 	// 257 "PATHName" created.
 	reply257PathNameCreated = 257
 
@@ -108,12 +125,21 @@ const (
 	// 504 Command not implemented for that parameter.
 	reply504CommandNotImplementedForThatParameter = 504
 
+	// 522 Network protocol not supported, use (1,2).
+	reply522NetworkProtocolNotSupported = 522
+
 	// 530 Not logged in.
 	reply530NotLoggedIn = 530
 
 	// 532 Need account for storing files.
 	reply532NeedAccountForStoringFiles = 532
 
+	// 534 Request denied for policy reasons.
+	reply534RequestDeniedForPolicyReasons = 534
+
+	// 536 Requested PROT level not supported by mechanism.
+	reply536ProtLevelNotSupported = 536
+
 	// 550 Requested action not taken. File unavailable (e.g., file not found,
 	// no access).
 	reply550RequestedActionNotTaken = 550
@@ -127,4 +153,33 @@ const (
 
 	// 553 Requested action not taken. File name not allowed.
 	reply553RequestedActionNotTakenFileNameNotAllowed = 553
+
+	// 554 Requested action not taken: invalid REST parameter.
+	reply554RequestedActionNotTakenInvalidRest = 554
 )
+
+// FtpReply 是发送给客户端的应答, Lines 多于一行时按多行格式发送, 中间行以空格开头
+type FtpReply struct {
+	Code  int
+	Lines []string
+}
+
+func NewFtpReply(code int, lines ...string) *FtpReply {
+	return &FtpReply{Code: code, Lines: lines}
+}
+
+func (reply *FtpReply) String() string {
+	code := strconv.Itoa(reply.Code)
+	if len(reply.Lines) <= 1 {
+		return code + " " + strings.Join(reply.Lines, "") + "\n"
+	}
+
+	var buf strings.Builder
+	last := len(reply.Lines) - 1
+	buf.WriteString(code + "-" + reply.Lines[0] + "\n")
+	for _, line := range reply.Lines[1:last] {
+		buf.WriteString(" " + line + "\n")
+	}
+	buf.WriteString(code + " " + reply.Lines[last] + "\n")
+	return buf.String()
+}
@@ -0,0 +1,650 @@
+package ftpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	pathpkg "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultS3PartSize int64 = 5 << 20
+
+	errS3NotSupported = errors.New("operation not supported by object storage")
+)
+
+// S3FileSystem 将FTP路径映射为S3兼容对象存储中的对象, 目录通过前缀和分隔符模拟,
+// 空目录用以 '/' 结尾的空对象表示
+type S3FileSystem struct {
+	// 对象存储服务地址, 如 https://s3.amazonaws.com 或 http://127.0.0.1:9000
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// 所有对象的公共前缀, 相当于用户的根目录
+	Prefix string
+	// 分片上传时每个分片的大小, 默认5MB
+	PartSize int64
+	Client   *http.Client
+}
+
+func NewS3FileSystem(endpoint, region, bucket, accessKey, secretKey string) *S3FileSystem {
+	return &S3FileSystem{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+}
+
+// S3Error 是对象存储返回的错误信息
+type S3Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// FTP路径对应的对象名称
+func (fs *S3FileSystem) key(path string) string {
+	path = strings.TrimPrefix(pathpkg.Clean("/"+path), "/")
+	prefix := strings.Trim(fs.Prefix, "/")
+	if prefix == "" {
+		return path
+	}
+	if path == "" {
+		return prefix
+	}
+	return prefix + "/" + path
+}
+
+// FTP目录对应的对象前缀, 根目录且没有公共前缀时为空
+func (fs *S3FileSystem) dirPrefix(path string) string {
+	key := fs.key(path)
+	if key == "" {
+		return ""
+	}
+	return key + "/"
+}
+
+func (fs *S3FileSystem) Stat(path string) (os.FileInfo, error) {
+	name := pathpkg.Base(pathpkg.Clean("/" + path))
+	if fs.key(path) == strings.Trim(fs.Prefix, "/") {
+		return &fileInfo{name: name, mode: os.ModeDir | 0755}, nil
+	}
+
+	resp, err := fs.do(http.MethodHead, fs.key(path), nil, nil, nil)
+	if err == nil {
+		_ = resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &fileInfo{name: name, size: resp.ContentLength, mode: 0644, modTime: modTime}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	// 不存在同名对象时, 只要有以它为前缀的对象就认为是目录
+	result, err := fs.list(fs.dirPrefix(path), "", "", 1)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	if len(result.Contents) == 0 {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return &fileInfo{name: name, mode: os.ModeDir | 0755, modTime: result.Contents[0].LastModified}, nil
+}
+
+func (fs *S3FileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	prefix := fs.dirPrefix(path)
+
+	var files []os.FileInfo
+	token := ""
+	for {
+		result, err := fs.list(prefix, "/", token, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "readdir", Path: path, Err: err}
+		}
+		for _, obj := range result.Contents {
+			// 跳过目录本身的占位对象
+			if obj.Key == prefix {
+				continue
+			}
+			files = append(files, &fileInfo{
+				name:    strings.TrimPrefix(obj.Key, prefix),
+				size:    obj.Size,
+				mode:    0644,
+				modTime: obj.LastModified,
+			})
+		}
+		for _, p := range result.CommonPrefixes {
+			files = append(files, &fileInfo{
+				name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"),
+				mode: os.ModeDir | 0755,
+			})
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	if len(files) == 0 && prefix != "" {
+		if _, err := fs.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	return files, nil
+}
+
+// 通过带Range的GET请求从offset处开始读取对象
+func (fs *S3FileSystem) Open(path string, offset int64) (io.ReadCloser, error) {
+	header := make(http.Header)
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := fs.do(http.MethodGet, fs.key(path), nil, header, nil)
+	if err != nil {
+		// 偏移量正好等于对象大小时没有可读取的内容
+		if e, ok := err.(*S3Error); ok && e.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return ioutil.NopCloser(bytes.NewReader(nil)), nil
+		}
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return resp.Body, nil
+}
+
+// 对象存储不支持从中间位置写入, offset必须为0
+func (fs *S3FileSystem) Create(path string, offset int64) (io.WriteCloser, error) {
+	if offset != 0 {
+		return nil, &os.PathError{Op: "create", Path: path, Err: errS3NotSupported}
+	}
+	return &s3Writer{fs: fs, key: fs.key(path)}, nil
+}
+
+// 上传时带上 If-None-Match: *, 对象已存在时对象存储拒绝写入
+func (fs *S3FileSystem) CreateNew(path string) (io.WriteCloser, error) {
+	if _, err := fs.Stat(path); err == nil {
+		return nil, &os.PathError{Op: "create", Path: path, Err: os.ErrExist}
+	}
+	return &s3Writer{fs: fs, key: fs.key(path), exclusive: true}, nil
+}
+
+func (fs *S3FileSystem) Append(path string) (io.WriteCloser, error) {
+	return nil, &os.PathError{Op: "append", Path: path, Err: errS3NotSupported}
+}
+
+func (fs *S3FileSystem) Remove(path string) error {
+	info, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	key := fs.key(path)
+	if info.IsDir() {
+		result, err := fs.list(fs.dirPrefix(path), "", "", 2)
+		if err != nil {
+			return &os.PathError{Op: "remove", Path: path, Err: err}
+		}
+		for _, obj := range result.Contents {
+			if obj.Key != key+"/" {
+				return &os.PathError{Op: "remove", Path: path, Err: errDirNotEmpty}
+			}
+		}
+		key += "/"
+	}
+
+	resp, err := fs.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: path, Err: err}
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// 对象存储没有重命名操作, 通过复制后删除实现, 目录会复制其下所有对象
+func (fs *S3FileSystem) Rename(from, to string) error {
+	info, err := fs.Stat(from)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fs.move(fs.key(from), fs.key(to))
+	}
+
+	src, dst := fs.dirPrefix(from), fs.dirPrefix(to)
+	if strings.HasPrefix(dst, src) {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: os.ErrInvalid}
+	}
+
+	token := ""
+	for {
+		result, err := fs.list(src, "", token, 0)
+		if err != nil {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+		}
+		for _, obj := range result.Contents {
+			if err := fs.move(obj.Key, dst+strings.TrimPrefix(obj.Key, src)); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (fs *S3FileSystem) move(src, dst string) error {
+	header := make(http.Header)
+	header.Set("X-Amz-Copy-Source", "/"+fs.Bucket+"/"+s3Escape(src, false))
+
+	resp, err := fs.do(http.MethodPut, dst, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	// 复制失败时也可能返回200, 错误信息在响应体中
+	if err := readS3Error(resp); err != nil {
+		return err
+	}
+
+	resp, err = fs.do(http.MethodDelete, src, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (fs *S3FileSystem) Mkdir(path string) error {
+	if _, err := fs.Stat(path); err == nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+
+	parent := pathpkg.Dir(pathpkg.Clean("/" + path))
+	if info, err := fs.Stat(parent); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrNotExist}
+	} else if !info.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: path, Err: errNotDir}
+	}
+
+	resp, err := fs.do(http.MethodPut, fs.dirPrefix(path), nil, nil, []byte{})
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+func (fs *S3FileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	return &os.PathError{Op: "chtimes", Path: path, Err: errS3NotSupported}
+}
+
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	Contents       []s3Object `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// ListObjectsV2
+func (fs *S3FileSystem) list(prefix, delimiter, token string, max int) (*s3ListResult, error) {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", prefix)
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+
+	resp, err := fs.do(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	result := new(s3ListResult)
+	if err := xml.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// 发送经过 AWS Signature Version 4 签名的请求, 非2xx的响应转换为错误返回
+func (fs *S3FileSystem) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	rawurl := fs.Endpoint + "/" + fs.Bucket
+	if key != "" {
+		rawurl += "/" + s3Escape(key, false)
+	}
+	if len(query) > 0 {
+		rawurl += "?" + s3Query(query)
+	}
+
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = nil
+	}
+	fs.sign(req, body, time.Now())
+
+	client := fs.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	e := &S3Error{StatusCode: resp.StatusCode}
+	if data, _ := ioutil.ReadAll(resp.Body); len(data) > 0 {
+		_ = xml.Unmarshal(data, e)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, os.ErrNotExist
+	}
+	return nil, e
+}
+
+// 读取并关闭响应体, 如果响应体是 <Error> 则返回对应的错误
+func readS3Error(resp *http.Response) error {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(data, []byte("<Error>")) {
+		return nil
+	}
+	e := &S3Error{StatusCode: resp.StatusCode}
+	_ = xml.Unmarshal(data, e)
+	return e
+}
+
+func (fs *S3FileSystem) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// 签名 host, range 以及所有 x-amz-* 请求头
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + fs.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+fs.SecretKey), date)
+	key = hmacSHA256(key, fs.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		fs.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// 按照SigV4的规则编码, 只保留 A-Z a-z 0-9 - _ . ~ 以及路径中的 '/'
+func s3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// 按键名排序的查询字符串, 同时用于请求和签名
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Writer 缓存写入的数据, 超过PartSize后以分片上传的方式流式写入,
+// 数据量较小时在Close时一次性上传
+type s3Writer struct {
+	fs        *S3FileSystem
+	key       string
+	exclusive bool
+	buf       bytes.Buffer
+	uploadID  string
+	parts     []s3Part
+	err       error
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (w *s3Writer) partSize() int64 {
+	if w.fs.PartSize > 0 {
+		return w.fs.PartSize
+	}
+	return defaultS3PartSize
+}
+
+func (w *s3Writer) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf.Write(b)
+	for int64(w.buf.Len()) >= w.partSize() {
+		if w.err = w.uploadPart(w.buf.Next(int(w.partSize()))); w.err != nil {
+			w.abort()
+			return 0, w.err
+		}
+	}
+	return len(b), nil
+}
+
+func (w *s3Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	var header http.Header
+	if w.exclusive {
+		header = http.Header{"If-None-Match": {"*"}}
+	}
+
+	// 数据量小于一个分片, 直接上传整个对象
+	if w.uploadID == "" {
+		resp, err := w.fs.do(http.MethodPut, w.key, nil, header, w.buf.Bytes())
+		if err != nil {
+			return w.existError(err)
+		}
+		_ = resp.Body.Close()
+		return nil
+	}
+
+	if w.buf.Len() > 0 {
+		if err := w.uploadPart(w.buf.Bytes()); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+	complete.Parts = w.parts
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		w.abort()
+		return err
+	}
+
+	query := url.Values{"uploadId": {w.uploadID}}
+	resp, err := w.fs.do(http.MethodPost, w.key, query, header, body)
+	if err == nil {
+		err = readS3Error(resp)
+	}
+	if err != nil {
+		w.abort()
+	}
+	return w.existError(err)
+}
+
+// 条件写入因对象已存在而失败时返回 os.ErrExist
+func (w *s3Writer) existError(err error) error {
+	if e, ok := err.(*S3Error); ok && w.exclusive && e.StatusCode == http.StatusPreconditionFailed {
+		return &os.PathError{Op: "create", Path: w.key, Err: os.ErrExist}
+	}
+	return err
+}
+
+func (w *s3Writer) uploadPart(data []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.fs.do(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			UploadID string `xml:"UploadId"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		w.uploadID = result.UploadID
+	}
+
+	number := len(w.parts) + 1
+	query := url.Values{
+		"partNumber": {strconv.Itoa(number)},
+		"uploadId":   {w.uploadID},
+	}
+	resp, err := w.fs.do(http.MethodPut, w.key, query, nil, data)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	w.parts = append(w.parts, s3Part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+	return nil
+}
+
+// 放弃未完成的分片上传, 释放对象存储中已上传的分片
+func (w *s3Writer) abort() {
+	if w.uploadID == "" {
+		return
+	}
+	resp, err := w.fs.do(http.MethodDelete, w.key, url.Values{"uploadId": {w.uploadID}}, nil, nil)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+	w.uploadID = ""
+}
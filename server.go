@@ -3,8 +3,10 @@ package ftpd
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -12,8 +14,12 @@ import (
 var (
 	//mutex sync.RWMutex
 
-	defaultName           = "Go FTP Server"
-	defaultWelcomeMessage = "Welcome to FTP Server"
+	defaultName            = "Go FTP Server"
+	defaultWelcomeMessage  = "Welcome to FTP Server"
+	defaultDataConnTimeout = 30 * time.Second
+	defaultIdleTimeout     = 5 * time.Minute
+	defaultLoginTimeout    = time.Minute
+	defaultDataTimeout     = 5 * time.Minute
 )
 
 type FtpServerOpt struct {
@@ -22,42 +28,125 @@ type FtpServerOpt struct {
 	Port           int
 	WelcomeMessage string
 	FtpUserManager FtpUserManager
+
+	// 被动模式数据通道的端口范围, 未设置时由系统分配
+	PasvMinPort int
+	PasvMaxPort int
+	// 被动模式返回给客户端的IP地址, 服务器位于NAT之后时需要设置为公网地址
+	PasvAddress string
+
+	// 以下超时时间为0时使用默认值, 小于0时不限制
+	// 控制通道空闲的超时时间, 默认5分钟
+	IdleTimeout time.Duration
+	// 连接后必须在该时间内完成登录, 默认1分钟
+	LoginTimeout time.Duration
+	// 建立数据通道的超时时间(被动模式等待客户端连接, 主动模式连接客户端), 默认30秒
+	DataConnTimeout time.Duration
+	// 数据传输停滞(没有任何数据读写)的超时时间, 默认5分钟
+	DataTimeout time.Duration
+
+	// 同时在线的会话数上限, 0表示不限制
+	MaxSessions int
+	// 每个IP同时在线的会话数上限, 0表示不限制
+	MaxSessionsPerIP int
+	// 每个IP在 ConnectionRateWindow 内允许建立的连接数, 0表示不限制
+	MaxConnectionsPerIP int
+	// 连接频率限制的时间窗口, 默认1分钟
+	ConnectionRateWindow time.Duration
+
+	// 组名到组的配额, 同组用户共享, 优先于用户自己的配额
+	GroupQuotas map[string]*GroupQuota
+
+	// 匿名登录的配置, 为nil时不允许匿名登录
+	Anonymous *AnonymousOpt
+
+	// 显式FTPS(AUTH TLS)使用的TLS配置, 为nil时不支持TLS
+	TLSConfig *tls.Config
+	// 为true时必须先执行 AUTH TLS 才能登录
+	ForceTLS bool
+	// 隐式FTPS模式(通常使用990端口), 连接建立后立即进行TLS握手, 需要同时设置TLSConfig
+	ImplicitTLS bool
 }
 
 type FtpServer struct {
+	// 会话ID计数器, 原子操作, 需要放在第一个字段保证64位对齐
+	sessionSeq  uint64
 	ftpListener map[string]FtpListener
 	opt         *FtpServerOpt
 	listen      net.Listener
 	ctx         context.Context
 	cancel      context.CancelFunc
 	mutex       sync.RWMutex
+	commands    map[string]Command
+	sessions    map[string]*FtpSession
+	// 每个IP的会话数和最近的连接时间, 用于连接限制
+	ipSessions         map[string]int
+	connections        map[string][]time.Time
+	connectionsSweepAt time.Time
+	// 每个用户(组)的配额使用量
+	quotas map[string]*quotaUsage
+	// 在线的匿名会话数
+	anonymousSessions int
+	// 会话和监听器回调的goroutine, Shutdown 会等待它们全部退出
+	wg         sync.WaitGroup
+	inShutdown bool
 }
 
 func NewFtpServer(opt *FtpServerOpt) *FtpServer {
+	commands := make(map[string]Command, len(defaultCommands))
+	for name, c := range defaultCommands {
+		commands[name] = c
+	}
 	return &FtpServer{
 		ftpListener: nil,
 		opt:         opt,
 		listen:      nil,
 		ctx:         nil,
 		cancel:      nil,
+		commands:    commands,
 	}
 }
 
 func (s *FtpServer) ListenAndServe() error {
-
-	var err error
-
-	s.listen, err = net.Listen("tcp", net.JoinHostPort(s.opt.Host, strconv.Itoa(s.opt.Port)))
+	listen, err := net.Listen("tcp", net.JoinHostPort(s.opt.Host, strconv.Itoa(s.opt.Port)))
 	if err != nil {
 		return err
 	}
+	return s.Serve(listen)
+}
+
+// 在指定的监听器上接受FTP连接, 直到服务器关闭
+func (s *FtpServer) Serve(listen net.Listener) error {
+
+	if s.opt.ImplicitTLS && s.opt.TLSConfig == nil {
+		_ = listen.Close()
+		return ErrTLSNotConfigured
+	}
+	if a := s.opt.Anonymous; a != nil && a.Root == "" && a.FileSystem == nil {
+		_ = listen.Close()
+		return ErrAnonymousRoot
+	}
+	for _, q := range s.opt.GroupQuotas {
+		if q != nil && q.Root == "" && q.FileSystem == nil {
+			_ = listen.Close()
+			return ErrGroupQuotaRoot
+		}
+	}
 
+	// 隐式FTPS模式下所有连接从第一个字节开始都是TLS
+	if s.opt.ImplicitTLS {
+		listen = tls.NewListener(listen, s.opt.TLSConfig)
+	}
+
+	s.mutex.Lock()
+	s.listen = listen
 	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.mutex.Unlock()
 
 	s.onStart()
 
 	for {
-		conn, err := s.listen.Accept()
+		conn, err := listen.Accept()
 		if err != nil {
 			select {
 			case <-s.ctx.Done():
@@ -70,20 +159,99 @@ func (s *FtpServer) ListenAndServe() error {
 			}
 		}
 
+		s.mutex.Lock()
+		if s.inShutdown {
+			// Shutdown 可能已经在等待 wg, 直接关闭连接
+			s.mutex.Unlock()
+			_ = conn.Close()
+			return ErrServerClosed
+		}
+		if !s.allowConnection(remoteIP(conn.RemoteAddr()), time.Now()) {
+			s.reject(conn, "Too many connections.")
+			s.mutex.Unlock()
+			continue
+		}
 		session := s.newFtpSession(conn)
+		s.addSession(session)
+		s.wg.Add(1)
+		s.mutex.Unlock()
 		go session.handler()
 	}
 
 }
 
-func (s *FtpServer) Shutdown() error {
+// 超时时间为0时使用默认值, 小于0时返回0表示不限制
+func timeoutOrDefault(timeout, def time.Duration) time.Duration {
+	if timeout == 0 {
+		return def
+	}
+	if timeout < 0 {
+		return 0
+	}
+	return timeout
+}
+
+// 关闭空闲会话的轮询间隔
+var shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown 优雅地关闭服务器: 停止接受新连接, 向空闲的会话发送421并断开,
+// 正在执行的命令(包括数据传输)完成后断开. ctx 结束时强制关闭剩余的会话并返回 ctx.Err().
+// 所有会话断开后调用监听器的 OnStop, 并等待所有goroutine退出后返回
+func (s *FtpServer) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	// 多次调用时只通知一次监听器
+	first := !s.inShutdown
+	s.inShutdown = true
 	if s.cancel != nil {
 		s.cancel()
 	}
-	if s.listen != nil {
-		return s.listen.Close()
+	var err error
+	if first && s.listen != nil {
+		err = s.listen.Close()
+	}
+	s.mutex.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !s.closeIdleSessions() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			s.closeAllSessions()
+		case <-ticker.C:
+			continue
+		}
+		break
+	}
+
+	if first {
+		s.onStop()
+	}
+	s.wg.Wait()
+	return err
+}
+
+func (s *FtpServer) shuttingDown() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.inShutdown
+}
+
+// 断开所有空闲的会话, 没有剩余会话时返回true
+func (s *FtpServer) closeIdleSessions() bool {
+	done := true
+	for _, session := range s.sessionList() {
+		if !session.closeIfIdle() {
+			done = false
+		}
+	}
+	return done
+}
+
+func (s *FtpServer) closeAllSessions() {
+	for _, session := range s.sessionList() {
+		session.forceClose()
 	}
-	return nil
 }
 
 func (s *FtpServer) newFtpSession(conn net.Conn) *FtpSession {
@@ -91,6 +259,7 @@ func (s *FtpServer) newFtpSession(conn net.Conn) *FtpSession {
 	session := new(FtpSession)
 	now := time.Now()
 
+	session.ID = s.nextSessionID()
 	session.CtrlConn = conn
 	session.CtrlReader = bufio.NewReader(conn)
 	session.CtrlWriter = bufio.NewWriter(conn)
@@ -101,12 +270,22 @@ func (s *FtpServer) newFtpSession(conn net.Conn) *FtpSession {
 	session.ConnectAt = now
 	session.LastAccessAt = now
 	session.CurrentDir = "/"
+	// 发送欢迎信息之前不会被当作空闲会话关闭
+	session.busy = true
+
+	// 隐式FTPS模式下数据通道默认也使用TLS
+	if s.opt.ImplicitTLS {
+		session.setAttribute(attributePbsz, "0")
+		session.setAttribute(attributeProt, protPrivate)
+	}
 
 	return session
 }
 
 func (s *FtpServer) onStart() {
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 		if s.ftpListener != nil {
@@ -118,7 +297,9 @@ func (s *FtpServer) onStart() {
 }
 
 func (s *FtpServer) onConnect(session *FtpSession) {
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 		if s.ftpListener != nil {
@@ -130,7 +311,9 @@ func (s *FtpServer) onConnect(session *FtpSession) {
 }
 
 func (s *FtpServer) beforeCommand(session *FtpSession, request *FtpRequest) {
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 		if s.ftpListener != nil {
@@ -142,7 +325,9 @@ func (s *FtpServer) beforeCommand(session *FtpSession, request *FtpRequest) {
 }
 
 func (s *FtpServer) afterCommand(session *FtpSession, request *FtpRequest) {
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 		if s.ftpListener != nil {
@@ -154,7 +339,9 @@ func (s *FtpServer) afterCommand(session *FtpSession, request *FtpRequest) {
 }
 
 func (s *FtpServer) onDisconnect(session *FtpSession) {
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 		if s.ftpListener != nil {
@@ -166,7 +353,9 @@ func (s *FtpServer) onDisconnect(session *FtpSession) {
 }
 
 func (s *FtpServer) onStop() {
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		s.mutex.RLock()
 		defer s.mutex.RUnlock()
 		if s.ftpListener != nil {
@@ -194,3 +383,50 @@ func (s *FtpServer) RemoveListener(name string) {
 		delete(s.ftpListener, name)
 	}
 }
+
+// RegisterCommand 注册命令处理器, 同名的命令(包括内置命令)会被替换.
+// OPTS 和 SITE 的子命令以 OPTS_<NAME>、SITE_<NAME> 为名注册
+func (s *FtpServer) RegisterCommand(name string, cmd Command) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.commands == nil {
+		s.commands = make(map[string]Command)
+	}
+	s.commands[strings.ToUpper(name)] = cmd
+}
+
+// UnregisterCommand 移除命令, 之后客户端执行该命令时返回502
+func (s *FtpServer) UnregisterCommand(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.commands, strings.ToUpper(name))
+}
+
+// RegisterSiteCommand 注册 SITE 子命令, 实现 Helper 接口的子命令会列在 SITE HELP 中
+func (s *FtpServer) RegisterSiteCommand(name string, cmd Command) {
+	s.RegisterCommand("SITE_"+name, cmd)
+}
+
+func (s *FtpServer) UnregisterSiteCommand(name string) {
+	s.UnregisterCommand("SITE_" + name)
+}
+
+// LookupCommand 返回已注册的命令处理器, 可用于在替换内置命令时调用原来的实现
+func (s *FtpServer) LookupCommand(name string) Command {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.commands[strings.ToUpper(name)]
+}
+
+// 已注册命令的快照
+func (s *FtpServer) registeredCommands() map[string]Command {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	commands := make(map[string]Command, len(s.commands))
+	for name, c := range s.commands {
+		commands[name] = c
+	}
+	return commands
+}
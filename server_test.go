@@ -1,19 +1,45 @@
 package ftpd
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
-	"log"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type fum struct {
+	fs      FileSystem
+	perm    Permission
+	permSet bool
+	group   string
+	paths   map[string]Permission
+	quota   *Quota
 }
 
-func (fum) Authenticate(username, password string) (*FtpUser, error) {
+func (m fum) Authenticate(username, password string) (*FtpUser, error) {
 	fu := &FtpUser{
-		Username: "admin",
-		Password: "123",
-		HomeDir:  "D:\\Software",
+		Username:        "admin",
+		Password:        "123",
+		FileSystem:      m.fs,
+		Permissions:     m.perm,
+		PermissionsSet:  m.permSet,
+		PathPermissions: m.paths,
+		Group:           m.group,
+		Quota:           m.quota,
 	}
 
 	if fu.Username == username && fu.Password == password {
@@ -23,23 +49,1456 @@ func (fum) Authenticate(username, password string) (*FtpUser, error) {
 	}
 }
 
-func TestFtpServer(t *testing.T) {
+// 启动一个监听在随机端口上的测试服务器, 返回服务器地址
+func startTestServer(t *testing.T, opt *FtpServerOpt) (*FtpServer, string) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opt.Name == "" {
+		opt.Name = defaultName
+	}
+	if opt.FtpUserManager == nil {
+		opt.FtpUserManager = fum{fs: NewMemFileSystem()}
+	}
+
+	server := NewFtpServer(opt)
+	go func() {
+		_ = server.Serve(listen)
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown(context.Background())
+	})
+
+	return server, listen.Addr().String()
+}
+
+type testClient struct {
+	*textproto.Conn
+	t *testing.T
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	c := &testClient{Conn: conn, t: t}
+	c.expect(reply220ServiceReady)
+	return c
+}
+
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+	_, message, err := c.ReadResponse(code)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return message
+}
+
+// 发送命令并检查应答码, 返回应答信息
+func (c *testClient) cmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+	if _, err := c.Cmd(format, args...); err != nil {
+		c.t.Fatal(err)
+	}
+	return c.expect(code)
+}
+
+func (c *testClient) login() {
+	c.t.Helper()
+	c.cmd(reply331UserNameOkayNeedPassword, "USER admin")
+	c.cmd(reply230UserLoggedIn, "PASS 123")
+}
+
+func (c *testClient) pasv() net.Conn {
+	c.t.Helper()
+	message := c.cmd(reply227EnteringPassiveMode, "PASV")
+
+	var h1, h2, h3, h4, p1, p2 int
+	start := strings.Index(message, "(")
+	if _, err := fmt.Sscanf(message[start:], "(%d,%d,%d,%d,%d,%d)", &h1, &h2, &h3, &h4, &p1, &p2); err != nil {
+		c.t.Fatal(err)
+	}
 
-	log.Print("Start...")
+	conn, err := net.Dial("tcp", fmt.Sprintf("%d.%d.%d.%d:%d", h1, h2, h3, h4, p1<<8|p2))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return conn
+}
+
+// 通过被动模式执行下载类命令, 返回数据通道收到的内容
+func (c *testClient) retrieve(format string, args ...interface{}) []byte {
+	c.t.Helper()
+	conn := c.pasv()
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	c.cmd(reply150FileStatusOkay, format, args...)
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.expect(reply226ClosingDataConnection)
+	return data
+}
+
+// 通过被动模式执行上传类命令
+func (c *testClient) store(data []byte, format string, args ...interface{}) string {
+	c.t.Helper()
+	conn := c.pasv()
+
+	message := c.cmd(reply150FileStatusOkay, format, args...)
+	if _, err := conn.Write(data); err != nil {
+		c.t.Fatal(err)
+	}
+	_ = conn.Close()
+	c.expect(reply226ClosingDataConnection)
+	return message
+}
+
+func TestLogin(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{})
+	c := dialTestClient(t, addr)
+
+	c.cmd(reply530NotLoggedIn, "PWD")
+	c.cmd(reply331UserNameOkayNeedPassword, "USER admin")
+	c.cmd(reply530NotLoggedIn, "PASS wrong")
+	c.login()
+	c.cmd(reply257PathNameCreated, "PWD")
+	c.cmd(reply221ClosingControlConnection, "QUIT")
+}
+
+func TestStoreAndRetrieve(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	c.store(content, "STOR data.bin")
 
-	var m fum
-	opt := FtpServerOpt{
-		Name:           defaultName,
-		Host:           "",
-		Port:           2121,
-		WelcomeMessage: defaultWelcomeMessage,
-		FtpUserManager: m,
+	if got := c.retrieve("RETR data.bin"); !bytes.Equal(got, content) {
+		t.Fatalf("RETR returned %d bytes, want %d", len(got), len(content))
 	}
+	if size := c.cmd(reply213FileStatus, "SIZE data.bin"); size != "100000" {
+		t.Fatalf("SIZE = %s, want 100000", size)
+	}
+
+	c.cmd(reply550RequestedActionNotTaken, "RETR missing.bin")
+}
 
-	server := NewFtpServer(&opt)
+func TestDirectoryCommands(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{})
+	c := dialTestClient(t, addr)
+	c.login()
 
-	if err := server.ListenAndServe(); err != nil {
-		t.Error(err)
+	c.cmd(reply257PathNameCreated, "MKD docs")
+	c.cmd(reply250RequestedFileActionOkay, "CWD docs")
+	if dir := c.cmd(reply257PathNameCreated, "PWD"); !strings.Contains(dir, `"/docs"`) {
+		t.Fatalf("PWD = %s", dir)
 	}
+	c.store([]byte("hello"), "STOR a.txt")
+	c.cmd(reply250RequestedFileActionOkay, "CWD /")
+
+	if names := string(c.retrieve("NLST docs")); names != "a.txt\r\n" {
+		t.Fatalf("NLST = %q", names)
+	}
+	if list := string(c.retrieve("LIST /docs")); !strings.Contains(list, " a.txt\r\n") {
+		t.Fatalf("LIST = %q", list)
+	}
+
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "RNFR docs/a.txt")
+	c.cmd(reply250RequestedFileActionOkay, "RNTO b.txt")
+	c.cmd(reply550RequestedActionNotTaken, "SIZE docs/a.txt")
+	c.cmd(reply213FileStatus, "SIZE b.txt")
+
+	c.cmd(reply450RequestedFileActionNotTaken, "RMD /")
+	c.cmd(reply250RequestedFileActionOkay, "RMD docs")
+	c.cmd(reply250RequestedFileActionOkay, "DELE b.txt")
+	c.cmd(reply550RequestedActionNotTaken, "CWD docs")
+}
 
+func TestExtendedPassiveMode(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	c.cmd(reply522NetworkProtocolNotSupported, "EPSV 2")
+	message := c.cmd(reply229EnteringExtendedPassiveMode, "EPSV")
+
+	var port int
+	start := strings.Index(message, "(")
+	if _, err := fmt.Sscanf(message[start:], "(|||%d|)", &port); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cmd(reply150FileStatusOkay, "STOR e.txt")
+	_, _ = conn.Write([]byte("extended"))
+	_ = conn.Close()
+	c.expect(reply226ClosingDataConnection)
+
+	c.cmd(reply200CommandOkay, "EPSV ALL")
+	c.cmd(reply503BadSequenceOfCommands, "PASV")
+	c.cmd(reply503BadSequenceOfCommands, "PORT 127,0,0,1,4,1")
+}
+
+// 把连接的地址换成非TCP地址的监听器, 模拟自定义的监听器
+type pipeAddrListener struct {
+	net.Listener
+}
+
+type pipeAddrConn struct {
+	net.Conn
+}
+
+func (l pipeAddrListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return pipeAddrConn{conn}, nil
+}
+
+func (c pipeAddrConn) LocalAddr() net.Addr  { return &net.UnixAddr{Name: "local", Net: "unix"} }
+func (c pipeAddrConn) RemoteAddr() net.Addr { return &net.UnixAddr{Name: "remote", Net: "unix"} }
+
+func TestNonTCPConn(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewFtpServer(&FtpServerOpt{Name: defaultName, FtpUserManager: fum{fs: NewMemFileSystem()}})
+	go func() {
+		_ = server.Serve(pipeAddrListener{listen})
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown(context.Background())
+	})
+
+	c := dialTestClient(t, listen.Addr().String())
+	c.login()
+	c.cmd(reply425CantOpenDataConnection, "PASV")
+	c.cmd(reply522NetworkProtocolNotSupported, "EPSV")
+	c.cmd(reply200CommandOkay, "NOOP")
+}
+
+func TestActiveMode(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+	c.store([]byte("active"), "STOR a.txt")
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = listen.Close()
+	}()
+	port := listen.Addr().(*net.TCPAddr).Port
+
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "EPRT |2|::1|%d|", port)
+	c.cmd(reply522NetworkProtocolNotSupported, "EPRT |3|127.0.0.1|%d|", port)
+	c.cmd(reply200CommandOkay, "EPRT |1|127.0.0.1|%d|", port)
+	c.cmd(reply150FileStatusOkay, "RETR a.txt")
+
+	conn, err := listen.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	_ = conn.Close()
+	c.expect(reply226ClosingDataConnection)
+
+	if string(data) != "active" {
+		t.Fatalf("RETR = %q", data)
+	}
+}
+
+func TestPasvPortRange(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{PasvMinPort: 42100, PasvMaxPort: 42110, PasvAddress: "10.0.0.1"})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	message := c.cmd(reply227EnteringPassiveMode, "PASV")
+
+	var h1, h2, h3, h4, p1, p2 int
+	start := strings.Index(message, "(")
+	if _, err := fmt.Sscanf(message[start:], "(%d,%d,%d,%d,%d,%d)", &h1, &h2, &h3, &h4, &p1, &p2); err != nil {
+		t.Fatal(err)
+	}
+	if ip := fmt.Sprintf("%d.%d.%d.%d", h1, h2, h3, h4); ip != "10.0.0.1" {
+		t.Fatalf("PASV address = %s, want 10.0.0.1", ip)
+	}
+	if port := p1<<8 | p2; port < 42100 || port > 42110 {
+		t.Fatalf("PASV port = %d, want in [42100, 42110]", port)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	c.store([]byte("0123456789"), "STOR r.txt")
+
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "REST 4")
+	if got := string(c.retrieve("RETR r.txt")); got != "456789" {
+		t.Fatalf("RETR after REST = %q", got)
+	}
+	// 偏移量只使用一次
+	if got := string(c.retrieve("RETR r.txt")); got != "0123456789" {
+		t.Fatalf("RETR without REST = %q", got)
+	}
+
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "REST 6")
+	c.store([]byte("abcdef"), "STOR r.txt")
+	if got := string(c.retrieve("RETR r.txt")); got != "012345abcdef" {
+		t.Fatalf("RETR after resumed STOR = %q", got)
+	}
+
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "REST abc")
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "REST -1")
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "REST 100")
+	c.cmd(reply554RequestedActionNotTakenInvalidRest, "RETR r.txt")
+
+	conn := c.pasv()
+	defer func() {
+		_ = conn.Close()
+	}()
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "REST 100")
+	c.cmd(reply554RequestedActionNotTakenInvalidRest, "STOR r.txt")
+}
+
+func TestFeat(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{})
+	c := dialTestClient(t, addr)
+
+	message := c.cmd(reply211SystemStatusreply, "FEAT")
+	if !strings.Contains(message, "\n REST STREAM\n") {
+		t.Fatalf("FEAT = %q", message)
+	}
+	if strings.Contains(message, "AUTH TLS") {
+		t.Fatalf("FEAT advertises AUTH TLS without TLS config: %q", message)
+	}
+	if !strings.Contains(message, "\n HASH SHA-1;SHA-256*;") || !strings.Contains(message, "\n MLST ") {
+		t.Fatalf("FEAT misses HASH or MLST: %q", message)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{})
+	c := dialTestClient(t, addr)
+
+	message := c.cmd(reply214HelpMessage, "HELP")
+	if !strings.Contains(message, "RETR") || !strings.Contains(message, "XSHA256") {
+		t.Fatalf("HELP = %q", message)
+	}
+	if strings.Contains(message, "AUTH") || strings.Contains(message, "SITE_") {
+		t.Fatalf("HELP lists unavailable commands: %q", message)
+	}
+
+	if message := c.cmd(reply214HelpMessage, "HELP cwd"); message != "Syntax: CWD <pathname> (change working directory)" {
+		t.Fatalf("HELP CWD = %q", message)
+	}
+	c.cmd(reply502CommandNotImplemented, "HELP AUTH")
+	c.cmd(reply502CommandNotImplemented, "HELP BOGUS")
+	c.cmd(reply502CommandNotImplemented, "AUTH TLS")
+}
+
+// HELP 中列出的命令都有应答
+func TestSimpleCommands(t *testing.T) {
+	fs := NewMemFileSystem()
+	_ = fs.Mkdir("/docs")
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	c.cmd(reply200CommandOkay, "MODE S")
+	c.cmd(reply504CommandNotImplementedForThatParameter, "MODE B")
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "MODE")
+	c.cmd(reply200CommandOkay, "STRU F")
+	c.cmd(reply504CommandNotImplementedForThatParameter, "STRU R")
+	c.cmd(reply200CommandOkay, "LANG")
+	c.cmd(reply200CommandOkay, "LANG en")
+	c.cmd(reply504CommandNotImplementedForThatParameter, "LANG fr")
+
+	c.cmd(reply250RequestedFileActionOkay, "CWD docs")
+	if reply := c.cmd(reply250RequestedFileActionOkay, "CDUP"); reply != `"/" is current directory.` {
+		t.Fatalf("CDUP = %q", reply)
+	}
+
+	c.store([]byte("hello"), "STOR docs/a.txt")
+	if reply := c.cmd(reply211SystemStatusreply, "STAT"); !strings.Contains(reply, "\n Logged in as admin\n") {
+		t.Fatalf("STAT = %q", reply)
+	}
+	if reply := c.cmd(reply213FileStatus, "STAT docs"); !strings.Contains(reply, " a.txt\n") {
+		t.Fatalf("STAT docs = %q", reply)
+	}
+	c.cmd(reply550RequestedActionNotTaken, "STAT missing")
+
+	// REIN 之后需要重新登录
+	c.cmd(reply220ServiceReady, "REIN")
+	c.cmd(reply530NotLoggedIn, "PWD")
+	c.login()
+	if reply := c.cmd(reply257PathNameCreated, "PWD"); reply != `"/" is current directory.` {
+		t.Fatalf("PWD after REIN = %q", reply)
+	}
+}
+
+// 生成只用于测试的自签名证书
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ftpd test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+var testClientTLSConfig = &tls.Config{InsecureSkipVerify: true}
+
+// 通过被动模式建立TLS数据通道
+func (c *testClient) pasvTLS() *tls.Conn {
+	c.t.Helper()
+	return tls.Client(c.pasv(), testClientTLSConfig)
+}
+
+func TestExplicitTLS(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}, TLSConfig: testTLSConfig(t)})
+
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = raw.Close()
+	})
+	c := &testClient{Conn: textproto.NewConn(raw), t: t}
+	c.expect(reply220ServiceReady)
+
+	if feat := c.cmd(reply211SystemStatusreply, "FEAT"); !strings.Contains(feat, "\n AUTH TLS\n") || !strings.Contains(feat, "\n PROT\n") {
+		t.Fatalf("FEAT = %q", feat)
+	}
+	c.cmd(reply503BadSequenceOfCommands, "PBSZ 0")
+	c.cmd(reply234SecurityDataExchangeComplete, "AUTH TLS")
+
+	conn := tls.Client(raw, testClientTLSConfig)
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c = &testClient{Conn: textproto.NewConn(conn), t: t}
+	c.login()
+	c.cmd(reply503BadSequenceOfCommands, "AUTH TLS")
+	c.cmd(reply503BadSequenceOfCommands, "PROT P")
+	c.cmd(reply200CommandOkay, "PBSZ 0")
+	c.cmd(reply536ProtLevelNotSupported, "PROT S")
+	c.cmd(reply200CommandOkay, "PROT P")
+
+	// PROT P 之后数据通道也使用TLS
+	data := c.pasvTLS()
+	c.cmd(reply150FileStatusOkay, "STOR secret.txt")
+	if _, err := data.Write([]byte("protected")); err != nil {
+		t.Fatal(err)
+	}
+	_ = data.Close()
+	c.expect(reply226ClosingDataConnection)
+	if !data.ConnectionState().HandshakeComplete {
+		t.Fatal("data connection is not TLS")
+	}
+
+	data = c.pasvTLS()
+	c.cmd(reply150FileStatusOkay, "RETR secret.txt")
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = data.Close()
+	c.expect(reply226ClosingDataConnection)
+	if string(got) != "protected" {
+		t.Fatalf("RETR = %q", got)
+	}
+
+	// PROT C 之后恢复明文数据通道
+	c.cmd(reply200CommandOkay, "PROT C")
+	if got := string(c.retrieve("RETR secret.txt")); got != "protected" {
+		t.Fatalf("RETR with PROT C = %q", got)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFtpServer(&FtpServerOpt{ImplicitTLS: true}).Serve(listen); err != ErrTLSNotConfigured {
+		t.Fatalf("Serve without TLS config = %v", err)
+	}
+
+	_, addr := startTestServer(t, &FtpServerOpt{TLSConfig: testTLSConfig(t), ImplicitTLS: true})
+	conn, err := tls.Dial("tcp", addr, testClientTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	c := &testClient{Conn: textproto.NewConn(conn), t: t}
+	c.expect(reply220ServiceReady)
+	c.login()
+	c.cmd(reply503BadSequenceOfCommands, "AUTH TLS")
+
+	// 不发送 PBSZ/PROT, 数据通道默认使用TLS
+	data := c.pasvTLS()
+	c.cmd(reply150FileStatusOkay, "STOR implicit.txt")
+	if _, err := data.Write([]byte("implicit")); err != nil {
+		t.Fatal(err)
+	}
+	_ = data.Close()
+	c.expect(reply226ClosingDataConnection)
+
+	data = c.pasvTLS()
+	c.cmd(reply150FileStatusOkay, "RETR implicit.txt")
+	got, err := ioutil.ReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = data.Close()
+	c.expect(reply226ClosingDataConnection)
+	if string(got) != "implicit" || !data.ConnectionState().HandshakeComplete {
+		t.Fatalf("RETR = %q", got)
+	}
+}
+
+func TestForceTLS(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{TLSConfig: testTLSConfig(t), ForceTLS: true})
+	c := dialTestClient(t, addr)
+	c.cmd(reply534RequestDeniedForPolicyReasons, "USER admin")
+}
+
+type versionCommand struct{}
+
+func (cmd versionCommand) Execute(session *FtpSession, request *FtpRequest) {
+	_ = session.Reply(NewFtpReply(reply211SystemStatusreply, "Version:", "ftpd test", "End"))
+}
+
+func (cmd versionCommand) Help() string {
+	return "(show server version)"
+}
+
+func (cmd versionCommand) Feature(session *FtpSession) string {
+	return "XVER"
+}
+
+func (cmd versionCommand) RequireAuth() bool {
+	return false
+}
+
+func TestCustomCommands(t *testing.T) {
+	fs := NewMemFileSystem()
+	server, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+
+	server.RegisterCommand("xver", versionCommand{})
+	server.UnregisterCommand("MDTM")
+	dele := server.LookupCommand("DELE")
+	server.RegisterCommand("DELE", CommandFunc(func(session *FtpSession, request *FtpRequest) {
+		if strings.HasSuffix(request.Argument, ".lock") {
+			_ = session.Reply(NewFtpReply(reply550RequestedActionNotTaken, "File is locked."))
+			return
+		}
+		dele.Execute(session, request)
+	}))
+
+	c := dialTestClient(t, addr)
+	if message := c.cmd(reply211SystemStatusreply, "XVER"); message != "Version:\n ftpd test\nEnd" {
+		t.Fatalf("XVER = %q", message)
+	}
+	message := c.cmd(reply211SystemStatusreply, "FEAT")
+	if !strings.Contains(message, "\n XVER\n") || strings.Contains(message, "MDTM") {
+		t.Fatalf("FEAT = %q", message)
+	}
+	c.cmd(reply214HelpMessage, "HELP XVER")
+	c.cmd(reply530NotLoggedIn, "DELE a.txt")
+
+	c.login()
+	writeMemFile(t, fs, "/a.txt", "a")
+	writeMemFile(t, fs, "/b.lock", "b")
+	c.cmd(reply550RequestedActionNotTaken, "DELE b.lock")
+	c.cmd(reply250RequestedFileActionOkay, "DELE a.txt")
+	c.cmd(reply502CommandNotImplemented, "MDTM b.lock")
+
+	if NewFtpServer(&FtpServerOpt{}).LookupCommand("XVER") != nil {
+		t.Fatal("command registered on one server leaked into another")
+	}
+}
+
+type siteEcho struct{}
+
+func (cmd siteEcho) Execute(session *FtpSession, request *FtpRequest) {
+	session.write(reply200CommandOkay, request.Command+": "+request.Argument)
+}
+
+func (cmd siteEcho) Help() string {
+	return "<text> (echo text)"
+}
+
+func TestSiteCommands(t *testing.T) {
+	server, addr := startTestServer(t, &FtpServerOpt{})
+	server.RegisterSiteCommand("echo", siteEcho{})
+	server.UnregisterSiteCommand("STAT")
+
+	c := dialTestClient(t, addr)
+	c.login()
+
+	if message := c.cmd(reply200CommandOkay, "SITE echo  hello world "); message != "SITE_ECHO: hello world" {
+		t.Fatalf("SITE ECHO = %q", message)
+	}
+	message := c.cmd(reply214HelpMessage, "SITE HELP")
+	if !strings.Contains(message, "\n ECHO       <text> (echo text)\n") || !strings.Contains(message, "\n ZONE ") ||
+		strings.Contains(message, "STAT") {
+		t.Fatalf("SITE HELP = %q", message)
+	}
+	if message := c.cmd(reply214HelpMessage, "SITE HELP echo"); message != "Syntax: SITE ECHO <text> (echo text)" {
+		t.Fatalf("SITE HELP ECHO = %q", message)
+	}
+	c.cmd(reply200CommandOkay, "SITE ZONE")
+	c.cmd(reply200CommandOkay, "SITE DESCUSER")
+	c.cmd(reply502CommandNotImplemented, "SITE STAT")
+	c.cmd(reply200CommandOkay, "SITE WHO")
+	c.cmd(reply502CommandNotImplemented, "SITE BOGUS arg")
+
+	if message := c.cmd(reply214HelpMessage, "HELP"); !strings.Contains(message, "SITE") {
+		t.Fatalf("HELP = %q", message)
+	}
+}
+
+// 等待条件成立, 超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionsOrder(t *testing.T) {
+	s := &FtpServer{}
+	now := time.Now()
+	for _, id := range []string{"10", "9", "100"} {
+		s.addSession(&FtpSession{ID: id, ConnectAt: now, RemoteAddr: &net.TCPAddr{}})
+	}
+	var ids []string
+	for _, info := range s.Sessions() {
+		ids = append(ids, info.ID)
+	}
+	if got := strings.Join(ids, ","); got != "9,10,100" {
+		t.Fatalf("Sessions() order = %s", got)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	fs := NewMemFileSystem()
+	if err := fs.Mkdir("/docs"); err != nil {
+		t.Fatal(err)
+	}
+	server, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+
+	anonymous := dialTestClient(t, addr)
+	c := dialTestClient(t, addr)
+	c.login()
+	c.cmd(reply250RequestedFileActionOkay, "CWD docs")
+
+	sessions := server.Sessions()
+	if len(sessions) != 2 {
+		t.Fatalf("Sessions() = %+v", sessions)
+	}
+	if sessions[0].ID == sessions[1].ID || sessions[0].Username != "" {
+		t.Fatalf("Sessions() = %+v", sessions)
+	}
+	if s := sessions[1]; s.Username != "admin" || s.CurrentDir != "/docs" || s.Transfer != nil ||
+		s.LastAccessAt.Before(s.ConnectAt) || s.RemoteAddr == nil {
+		t.Fatalf("logged in session = %+v", s)
+	}
+
+	conn := c.pasv()
+	c.cmd(reply150FileStatusOkay, "STOR big.bin")
+	if _, err := conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "transfer progress", func() bool {
+		tr := server.Sessions()[1].Transfer
+		return tr != nil && tr.Command == "STOR" && tr.Argument == "big.bin" && tr.Bytes == 1000
+	})
+
+	other := dialTestClient(t, addr)
+	other.login()
+	message := other.cmd(reply200CommandOkay, "SITE WHO")
+	// 没有登录的会话不属于当前用户, 不会列出
+	if !strings.Contains(message, " admin ") || !strings.Contains(message, "/docs STOR big.bin (1000 bytes)") ||
+		strings.Count(message, "\n ") != 2 {
+		t.Fatalf("SITE WHO = %q", message)
+	}
+	if message := other.cmd(reply200CommandOkay, "SITE STAT"); !strings.Contains(message, "sessions  : 3") ||
+		!strings.Contains(message, "logged in : 2") || !strings.Contains(message, "transfers : 1") {
+		t.Fatalf("SITE STAT = %q", message)
+	}
+
+	_ = conn.Close()
+	c.expect(reply226ClosingDataConnection)
+	if tr := server.Sessions()[1].Transfer; tr != nil {
+		t.Fatalf("transfer still reported: %+v", tr)
+	}
+
+	anonymous.cmd(reply221ClosingControlConnection, "QUIT")
+	waitFor(t, "session removal", func() bool {
+		return len(server.Sessions()) == 2
+	})
+}
+
+type stopListener struct {
+	stopped chan struct{}
+}
+
+func (l stopListener) OnStart(*FtpServer)                     {}
+func (l stopListener) OnConnect(*FtpSession)                  {}
+func (l stopListener) BeforeCommand(*FtpSession, *FtpRequest) {}
+func (l stopListener) AfterCommand(*FtpSession, *FtpRequest)  {}
+func (l stopListener) OnDisconnect(*FtpSession)               {}
+func (l stopListener) OnStop(*FtpServer)                      { close(l.stopped) }
+
+func TestShutdown(t *testing.T) {
+	fs := NewMemFileSystem()
+	server, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	lsn := stopListener{stopped: make(chan struct{})}
+	server.AddListener("stop", lsn)
+
+	idle := dialTestClient(t, addr)
+	idle.login()
+	c := dialTestClient(t, addr)
+	c.login()
+	conn := c.pasv()
+	c.cmd(reply150FileStatusOkay, "STOR upload.txt")
+	if _, err := conn.Write([]byte("first ")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "transfer start", func() bool {
+		return server.Sessions()[1].Transfer != nil
+	})
+
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result <- server.Shutdown(ctx)
+	}()
+
+	idle.expect(reply421ServiceNotAvailableClosingControlConnection)
+	waitFor(t, "listener close", func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err != nil
+	})
+
+	// 正在进行的传输可以完成
+	if _, err := conn.Write([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	c.expect(reply226ClosingDataConnection)
+	c.expect(reply421ServiceNotAvailableClosingControlConnection)
+
+	if err := <-result; err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	select {
+	case <-lsn.stopped:
+	default:
+		t.Fatal("OnStop was not called")
+	}
+	if n := len(server.Sessions()); n != 0 {
+		t.Fatalf("%d sessions left after shutdown", n)
+	}
+	if got := readMemFile(t, fs, "/upload.txt", 0); got != "first second" {
+		t.Fatalf("uploaded = %q", got)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	server, addr := startTestServer(t, &FtpServerOpt{})
+	c := dialTestClient(t, addr)
+	c.login()
+	conn := c.pasv()
+	defer func() {
+		_ = conn.Close()
+	}()
+	c.cmd(reply150FileStatusOkay, "STOR stalled.txt")
+	waitFor(t, "transfer start", func() bool {
+		return server.Sessions()[0].Transfer != nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if n := len(server.Sessions()); n != 0 {
+		t.Fatalf("%d sessions left after shutdown", n)
+	}
+}
+
+// 通过 net.Pipe 建立连接的监听器, 客户端不读取时服务器的写入会一直阻塞
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func (l *pipeListener) dial() net.Conn {
+	server, client := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+// 不读取421的客户端不会阻塞服务器关闭, 也不会阻塞其他使用会话列表的操作
+func TestShutdownStalledClient(t *testing.T) {
+	timeout := rejectTimeout
+	rejectTimeout = 200 * time.Millisecond
+	defer func() {
+		rejectTimeout = timeout
+	}()
+
+	listen := newPipeListener()
+	server := NewFtpServer(&FtpServerOpt{Name: defaultName, FtpUserManager: fum{fs: NewMemFileSystem()}})
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listen)
+	}()
+
+	conn := listen.dial()
+	defer func() {
+		_ = conn.Close()
+	}()
+	c := &testClient{Conn: textproto.NewConn(conn), t: t}
+	c.expect(reply220ServiceReady)
+	c.login()
+
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		result <- server.Shutdown(ctx)
+	}()
+	waitFor(t, "shutdown start", server.shuttingDown)
+	_ = server.Sessions()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatalf("Shutdown() = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Shutdown blocked by a client that does not read")
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve() = %v", err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{
+		LoginTimeout:    200 * time.Millisecond,
+		IdleTimeout:     300 * time.Millisecond,
+		DataConnTimeout: 200 * time.Millisecond,
+		DataTimeout:     200 * time.Millisecond,
+	})
+
+	// 登录超时从连接时开始计算, 不会因为发送命令而延长
+	c := dialTestClient(t, addr)
+	c.cmd(reply530NotLoggedIn, "PWD")
+	if message := c.expect(reply421ServiceNotAvailableClosingControlConnection); message != "Login timeout." {
+		t.Fatalf("login timeout = %q", message)
+	}
+
+	c = dialTestClient(t, addr)
+	c.login()
+	time.Sleep(150 * time.Millisecond)
+	c.cmd(reply257PathNameCreated, "PWD")
+	if message := c.expect(reply421ServiceNotAvailableClosingControlConnection); !strings.HasPrefix(message, "Timeout") {
+		t.Fatalf("idle timeout = %q", message)
+	}
+
+	// 客户端没有连接被动模式的数据通道
+	c = dialTestClient(t, addr)
+	c.login()
+	c.cmd(reply227EnteringPassiveMode, "PASV")
+	c.cmd(reply150FileStatusOkay, "NLST")
+	c.expect(reply426ConnectionClosedTransferAborted)
+
+	// 上传停滞
+	conn := c.pasv()
+	defer func() {
+		_ = conn.Close()
+	}()
+	c.cmd(reply150FileStatusOkay, "STOR stalled.txt")
+	if _, err := conn.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	if message := c.expect(reply426ConnectionClosedTransferAborted); message != "Data connection timed out; transfer aborted." {
+		t.Fatalf("stalled transfer = %q", message)
+	}
+}
+
+// 连接服务器并期望连接被拒绝
+func expectRejected(t *testing.T, addr string) {
+	t.Helper()
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, message, err := conn.ReadResponse(reply421ServiceNotAvailableClosingControlConnection)
+	if err != nil || message != "Too many connections." {
+		t.Fatalf("rejected connection reply = %q, %v", message, err)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	server, addr := startTestServer(t, &FtpServerOpt{MaxSessionsPerIP: 2})
+
+	first := dialTestClient(t, addr)
+	dialTestClient(t, addr)
+	expectRejected(t, addr)
+
+	first.cmd(reply221ClosingControlConnection, "QUIT")
+	waitFor(t, "session removal", func() bool {
+		return len(server.Sessions()) == 1
+	})
+	dialTestClient(t, addr)
+	expectRejected(t, addr)
+
+	_, addr = startTestServer(t, &FtpServerOpt{MaxSessions: 2})
+	dialTestClient(t, addr)
+	dialTestClient(t, addr)
+	expectRejected(t, addr)
+}
+
+func TestConnectionRate(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{
+		MaxConnectionsPerIP:  2,
+		ConnectionRateWindow: 300 * time.Millisecond,
+	})
+
+	dialTestClient(t, addr)
+	dialTestClient(t, addr)
+	expectRejected(t, addr)
+
+	time.Sleep(350 * time.Millisecond)
+	dialTestClient(t, addr)
+}
+
+func TestPermissions(t *testing.T) {
+	fs := NewMemFileSystem()
+	writeMemFile(t, fs, "/readme.txt", "hello")
+	for _, dir := range []string{"/incoming", "/incoming/private"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMemFile(t, fs, "/incoming/private/secret.txt", "secret")
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{
+		fs:   fs,
+		perm: PermReadOnly | PermRmdir,
+		paths: map[string]Permission{
+			"/incoming":         PermList | PermWrite,
+			"incoming/private/": 0,
+		},
+	}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	denied := func(format string, args ...interface{}) {
+		t.Helper()
+		if message := c.cmd(reply550RequestedActionNotTaken, format, args...); message != "Permission denied." {
+			t.Fatalf("%s = %q", fmt.Sprintf(format, args...), message)
+		}
+	}
+
+	if got := string(c.retrieve("RETR readme.txt")); got != "hello" {
+		t.Fatalf("RETR = %q", got)
+	}
+	denied("DELE readme.txt")
+	denied("MKD docs")
+	// RMD 不能删除文件
+	if message := c.cmd(reply550RequestedActionNotTaken, "RMD readme.txt"); message != "Not a directory." {
+		t.Fatalf("RMD readme.txt = %q", message)
+	}
+	if _, err := fs.Stat("/readme.txt"); err != nil {
+		t.Fatal(err)
+	}
+	denied("RMD incoming")
+	denied("RNFR readme.txt")
+	denied("MFMT 20200101000000 readme.txt")
+	conn := c.pasv()
+	denied("STOR new.txt")
+	_ = conn.Close()
+
+	c.store([]byte("old upload"), "STOR incoming/upload.txt")
+	// 普通用户有上传权限就可以覆盖已有文件和断点续传
+	c.store([]byte("upl"), "STOR incoming/upload.txt")
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "REST 3")
+	c.store([]byte("oad"), "STOR incoming/upload.txt")
+	denied("RETR incoming/upload.txt")
+	denied("XMD5 incoming/upload.txt")
+	conn = c.pasv()
+	denied("APPE incoming/upload.txt")
+	_ = conn.Close()
+	c.cmd(reply250RequestedFileActionOkay, "CWD incoming")
+
+	denied("CWD private")
+	denied("SIZE /incoming/private/secret.txt")
+	denied("NLST /incoming/private")
+	if got := readMemFile(t, fs, "/incoming/upload.txt", 0); got != "upload" {
+		t.Fatalf("uploaded = %q", got)
+	}
+	// 没有权限时文件存在与否的响应相同
+	denied("SIZE /incoming/private/missing.txt")
+	denied("MDTM /incoming/private/secret.txt")
+	denied("MDTM /incoming/private/missing.txt")
+	denied("RETR /incoming/private/missing.txt")
+}
+
+func TestNoPermissions(t *testing.T) {
+	fs := NewMemFileSystem()
+	writeMemFile(t, fs, "/readme.txt", "hello")
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs, permSet: true}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	for _, cmd := range []string{"SIZE readme.txt", "RETR readme.txt", "RETR missing.txt", "NLST", "MKD docs"} {
+		if message := c.cmd(reply550RequestedActionNotTaken, cmd); message != "Permission denied." {
+			t.Fatalf("%s = %q", cmd, message)
+		}
+	}
+}
+
+// 上传超出配额的数据, 期望552
+func (c *testClient) storeExceeded(data []byte, format string, args ...interface{}) {
+	c.t.Helper()
+	conn := c.pasv()
+	c.cmd(reply150FileStatusOkay, format, args...)
+	_, _ = conn.Write(data)
+	_ = conn.Close()
+	c.expect(reply552RequestedFileActionAbortedExceededStorage)
+}
+
+func TestQuota(t *testing.T) {
+	fs := NewMemFileSystem()
+	writeMemFile(t, fs, "/old.txt", "0123456789")
+	quota := &Quota{MaxBytes: 30, MaxFiles: 3}
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs, quota: quota}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	usage := func(want string) {
+		t.Helper()
+		if message := c.cmd(reply200CommandOkay, "SITE QUOTA"); message != "Quota for user admin:\n"+want+"\nEnd" {
+			t.Fatalf("SITE QUOTA = %q", message)
+		}
+	}
+	usage(" bytes : 10 / 30\n files : 1 / 3")
+
+	c.store([]byte("abcdefghijklmno"), "STOR a.txt")
+	usage(" bytes : 25 / 30\n files : 2 / 3")
+
+	// 新建的文件超出配额后被删除
+	c.storeExceeded(make([]byte, 20), "STOR big.txt")
+	if _, err := fs.Stat("/big.txt"); err == nil {
+		t.Fatal("partial upload was not removed")
+	}
+	usage(" bytes : 25 / 30\n files : 2 / 3")
+
+	// 追加时保留配额以内的部分
+	c.storeExceeded([]byte("0123456789"), "APPE a.txt")
+	if got := readMemFile(t, fs, "/a.txt", 0); got != "abcdefghijklmno01234" {
+		t.Fatalf("appended file = %q", got)
+	}
+	usage(" bytes : 30 / 30\n files : 2 / 3")
+
+	// 覆盖已有文件时只计算新的大小
+	c.store([]byte("xyz"), "STOR a.txt")
+	usage(" bytes : 13 / 30\n files : 2 / 3")
+	c.cmd(reply250RequestedFileActionOkay, "DELE old.txt")
+	usage(" bytes : 3 / 30\n files : 1 / 3")
+	// 文件只能通过 DELE 删除, 使用量不会与实际的文件不一致
+	c.cmd(reply550RequestedActionNotTaken, "RMD a.txt")
+	usage(" bytes : 3 / 30\n files : 1 / 3")
+
+	c.store(nil, "STOR b.txt")
+	c.store(nil, "STOR c.txt")
+	conn := c.pasv()
+	c.cmd(reply552RequestedFileActionAbortedExceededStorage, "STOR d.txt")
+	_ = conn.Close()
+
+	// 同一用户的其他会话共享使用量
+	other := dialTestClient(t, addr)
+	other.login()
+	if message := other.cmd(reply200CommandOkay, "SITE QUOTA"); !strings.Contains(message, "files : 3 / 3") {
+		t.Fatalf("SITE QUOTA = %q", message)
+	}
+}
+
+func TestGroupQuota(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := &FtpServerOpt{GroupQuotas: map[string]*GroupQuota{"staff": {Quota: Quota{MaxFiles: 2}}}}
+	if err := NewFtpServer(opt).Serve(listen); err != ErrGroupQuotaRoot {
+		t.Fatalf("Serve without group root = %v", err)
+	}
+
+	fs := NewMemFileSystem()
+	writeMemFile(t, fs, "/old.txt", "0123456789")
+	// 组的配额优先于用户自己的配额
+	_, addr := startTestServer(t, &FtpServerOpt{
+		FtpUserManager: fum{fs: fs, group: "staff", quota: &Quota{MaxFiles: 10}},
+		GroupQuotas:    map[string]*GroupQuota{"staff": {Quota: Quota{MaxFiles: 2}, FileSystem: fs}},
+	})
+	c := dialTestClient(t, addr)
+	c.login()
+	if message := c.cmd(reply200CommandOkay, "SITE QUOTA"); message != "Quota for group staff:\n bytes : 10 / unlimited\n files : 1 / 2\nEnd" {
+		t.Fatalf("SITE QUOTA = %q", message)
+	}
+
+	c.store([]byte("a"), "STOR a.txt")
+	conn := c.pasv()
+	c.cmd(reply552RequestedFileActionAbortedExceededStorage, "STOR b.txt")
+	_ = conn.Close()
+}
+
+func TestQuotaKeepPartial(t *testing.T) {
+	fs := NewMemFileSystem()
+	quota := &Quota{MaxBytes: 5, Policy: QuotaKeepPartial}
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs, quota: quota}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	c.storeExceeded([]byte("0123456789"), "STOR partial.txt")
+	if got := readMemFile(t, fs, "/partial.txt", 0); got != "01234" {
+		t.Fatalf("partial file = %q", got)
+	}
+	c.cmd(reply200CommandOkay, "SITE QUOTA")
+}
+
+func TestAnonymous(t *testing.T) {
+	fs := NewMemFileSystem()
+	for _, dir := range []string{"/pub", "/incoming"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMemFile(t, fs, "/pub/file.txt", "public")
+	_, addr := startTestServer(t, &FtpServerOpt{Anonymous: &AnonymousOpt{
+		FileSystem:  fs,
+		IncomingDir: "incoming",
+		MaxSessions: 1,
+	}})
+
+	c := dialTestClient(t, addr)
+	c.cmd(reply331UserNameOkayNeedPassword, "USER anonymous")
+	c.cmd(reply530NotLoggedIn, "PASS secret")
+	c.cmd(reply230UserLoggedIn, "PASS guest@example.com")
+
+	if got := string(c.retrieve("RETR pub/file.txt")); got != "public" {
+		t.Fatalf("RETR = %q", got)
+	}
+	c.cmd(reply550RequestedActionNotTaken, "DELE pub/file.txt")
+	c.cmd(reply550RequestedActionNotTaken, "MKD pub/new")
+	conn := c.pasv()
+	c.cmd(reply550RequestedActionNotTaken, "STOR pub/upload.txt")
+	_ = conn.Close()
+
+	// 上传目录只能上传新文件, 文件是否存在都返回相同的响应
+	c.store([]byte("upload"), "STOR incoming/upload.txt")
+	same := func(existing, missing string, pasv bool) {
+		t.Helper()
+		var messages [2]string
+		for i, cmd := range []string{existing, missing} {
+			var conn net.Conn
+			if pasv {
+				conn = c.pasv()
+			}
+			messages[i] = c.cmd(reply550RequestedActionNotTaken, cmd)
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+		if messages[0] != messages[1] {
+			t.Fatalf("%s = %q, %s = %q", existing, messages[0], missing, messages[1])
+		}
+	}
+	same("SIZE incoming/upload.txt", "SIZE incoming/missing.txt", false)
+	same("RETR incoming/upload.txt", "RETR incoming/missing.txt", true)
+	same("STOR incoming/upload.txt", "STOR incoming/missing/upload.txt", true)
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "REST 3")
+	conn = c.pasv()
+	c.cmd(reply550RequestedActionNotTaken, "STOR incoming/upload.txt")
+	_ = conn.Close()
+	c.cmd(reply550RequestedActionNotTaken, "NLST incoming")
+	c.cmd(reply502CommandNotImplemented, "SITE WHO")
+	c.cmd(reply502CommandNotImplemented, "SITE DESCUSER")
+	if message := c.cmd(reply214HelpMessage, "SITE HELP"); strings.Contains(message, "DESCUSER") {
+		t.Fatalf("SITE HELP = %q", message)
+	}
+	if got := readMemFile(t, fs, "/incoming/upload.txt", 0); got != "upload" {
+		t.Fatalf("uploaded = %q", got)
+	}
+
+	other := dialTestClient(t, addr)
+	other.cmd(reply331UserNameOkayNeedPassword, "USER ftp")
+	other.cmd(reply530NotLoggedIn, "PASS guest@example.com")
+	c.cmd(reply221ClosingControlConnection, "QUIT")
+	waitFor(t, "anonymous session close", func() bool {
+		_, err := other.Cmd("PASS guest@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, _, _ := other.ReadResponse(0)
+		return code == reply230UserLoggedIn
+	})
+
+	// 普通用户仍然通过用户管理器登录
+	dialTestClient(t, addr).login()
+}
+
+func TestAnonymousRoot(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFtpServer(&FtpServerOpt{Anonymous: &AnonymousOpt{}}).Serve(listen); err != ErrAnonymousRoot {
+		t.Fatalf("Serve without anonymous root = %v", err)
+	}
+}
+
+func TestAnonymousDisabled(t *testing.T) {
+	_, addr := startTestServer(t, &FtpServerOpt{})
+	c := dialTestClient(t, addr)
+	c.cmd(reply331UserNameOkayNeedPassword, "USER anonymous")
+	c.cmd(reply530NotLoggedIn, "PASS guest@example.com")
+}
+
+func TestAppendAndStoreUnique(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	c.store([]byte("first\n"), "APPE log.txt")
+	c.store([]byte("second\n"), "APPE log.txt")
+	if got := string(c.retrieve("RETR log.txt")); got != "first\nsecond\n" {
+		t.Fatalf("RETR after APPE = %q", got)
+	}
+
+	names := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		message := c.store([]byte("unique"), "STOU")
+		name := strings.TrimPrefix(message, "FILE: ")
+		if name == message || names[name] {
+			t.Fatalf("STOU reply = %q", message)
+		}
+		names[name] = true
+		if got := string(c.retrieve("RETR %s", name)); got != "unique" {
+			t.Fatalf("RETR %s = %q", name, got)
+		}
+	}
+
+	message := c.store([]byte("report"), "STOU report.csv")
+	if !strings.HasPrefix(message, "FILE: report.csv.") {
+		t.Fatalf("STOU with prefix reply = %q", message)
+	}
+}
+
+func TestMachineListing(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+
+	c.cmd(reply257PathNameCreated, "MKD sub")
+	c.store([]byte("12345"), "STOR a.txt")
+	mtime := time.Date(2019, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := fs.Chtimes("/a.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	message := c.cmd(reply250RequestedFileActionOkay, "MLST a.txt")
+	if !strings.Contains(message, "\n type=file;size=5;modify=20190304050607;perm=radfw;UNIX.mode=0644; /a.txt\n") {
+		t.Fatalf("MLST = %q", message)
+	}
+
+	listing := string(c.retrieve("MLSD"))
+	if !strings.Contains(listing, "type=dir;modify=") || !strings.Contains(listing, "; sub\r\n") {
+		t.Fatalf("MLSD = %q", listing)
+	}
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "MLSD a.txt")
+
+	if opts := c.cmd(reply200CommandOkay, "OPTS MLST size;Type;bogus;"); opts != "MLST OPTS type;size;" {
+		t.Fatalf("OPTS MLST = %q", opts)
+	}
+	if listing := string(c.retrieve("MLSD /")); listing != "type=file;size=5; a.txt\r\ntype=dir; sub\r\n" {
+		t.Fatalf("MLSD with selected facts = %q", listing)
+	}
+	if feat := c.cmd(reply211SystemStatusreply, "FEAT"); !strings.Contains(feat, " MLST type*;size*;modify;perm;") {
+		t.Fatalf("FEAT = %q", feat)
+	}
+}
+
+func TestModifyTime(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+	c.store([]byte("x"), "STOR m.txt")
+
+	if reply := c.cmd(reply213FileStatus, "MFMT 20200102030405 m.txt"); reply != "Modify=20200102030405; m.txt" {
+		t.Fatalf("MFMT = %q", reply)
+	}
+	if reply := c.cmd(reply213FileStatus, "MDTM m.txt"); reply != "20200102030405" {
+		t.Fatalf("MDTM = %q", reply)
+	}
+
+	c.cmd(reply213FileStatus, "MDTM 20210102030405.25 m.txt")
+	if reply := c.cmd(reply213FileStatus, "MDTM m.txt"); reply != "20210102030405.250" {
+		t.Fatalf("MDTM after legacy set = %q", reply)
+	}
+
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "MFMT 2020 m.txt")
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "MFMT 20200102030405")
+	c.cmd(reply550RequestedActionNotTaken, "MFMT 20200102030405 missing.txt")
+	c.cmd(reply550RequestedActionNotTaken, "MDTM missing.txt")
+}
+
+func TestChecksums(t *testing.T) {
+	fs := NewMemFileSystem()
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: fum{fs: fs}})
+	c := dialTestClient(t, addr)
+	c.login()
+	c.store([]byte("hello world"), "STOR h.txt")
+
+	sha256Sum := "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+	if reply := c.cmd(reply213FileStatus, "HASH h.txt"); reply != "SHA-256 0-10 "+sha256Sum+" h.txt" {
+		t.Fatalf("HASH = %q", reply)
+	}
+
+	c.cmd(reply200CommandOkay, "OPTS HASH md5")
+	c.cmd(reply504CommandNotImplementedForThatParameter, "OPTS HASH SHA-3")
+	if reply := c.cmd(reply200CommandOkay, "OPTS HASH"); reply != "MD5" {
+		t.Fatalf("OPTS HASH = %q", reply)
+	}
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "RANG 0 4")
+	if reply := c.cmd(reply213FileStatus, "HASH h.txt"); reply != "MD5 0-4 5d41402abc4b2a76b9719d911017c592 h.txt" {
+		t.Fatalf("HASH with RANG = %q", reply)
+	}
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "REST 6")
+	if reply := c.cmd(reply213FileStatus, "HASH h.txt"); reply != "MD5 6-10 7d793037a0760186574b0282f2f435e7 h.txt" {
+		t.Fatalf("HASH with REST = %q", reply)
+	}
+	c.cmd(reply501SyntaxErrorInParametersOrArguments, "RANG 5 1")
+
+	// RANG 也作用于 RETR 和 STOR
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "RANG 2 5")
+	if got := string(c.retrieve("RETR h.txt")); got != "llo " {
+		t.Fatalf("RETR with RANG = %q", got)
+	}
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "RANG 6 10")
+	c.store([]byte("there"), "STOR h.txt")
+	if got := string(c.retrieve("RETR h.txt")); got != "hello there" {
+		t.Fatalf("STOR with RANG = %q", got)
+	}
+	data := c.pasv()
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "RANG 0 1")
+	c.cmd(reply554RequestedActionNotTakenInvalidRest, "STOR h.txt")
+	_ = data.Close()
+	c.cmd(reply350RequestedFileActionPendingFurtherInformation, "RANG 6 7")
+	data = c.pasv()
+	c.cmd(reply150FileStatusOkay, "STOR h.txt")
+	_, _ = data.Write([]byte("world"))
+	_ = data.Close()
+	c.expect(reply551RequestedActionAbortedPageTypeUnknown)
+	c.store([]byte("hello world"), "STOR h.txt")
+	if feat := c.cmd(reply211SystemStatusreply, "FEAT"); !strings.Contains(feat, " HASH SHA-1;SHA-256;SHA-512;MD5*;CRC32\n") {
+		t.Fatalf("FEAT = %q", feat)
+	}
+
+	if reply := c.cmd(reply251FileChecksum, "MD5 h.txt"); reply != "h.txt 5EB63BBBE01EEED093CB22BB8F5ACDC3" {
+		t.Fatalf("MD5 = %q", reply)
+	}
+	c.cmd(reply252FileChecksums, "MMD5 h.txt, h.txt")
+	c.cmd(reply550RequestedActionNotTaken, "MMD5 h.txt, missing.txt")
+	if reply := c.cmd(reply250RequestedFileActionOkay, "XCRC h.txt"); reply != "0D4A1185" {
+		t.Fatalf("XCRC = %q", reply)
+	}
+	if reply := c.cmd(reply250RequestedFileActionOkay, "XSHA256 h.txt"); reply != strings.ToUpper(sha256Sum) {
+		t.Fatalf("XSHA256 = %q", reply)
+	}
+	if reply := c.cmd(reply250RequestedFileActionOkay, "XMD5 h.txt 0 5"); reply != "5D41402ABC4B2A76B9719D911017C592" {
+		t.Fatalf("XMD5 with range = %q", reply)
+	}
 }
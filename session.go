@@ -2,14 +2,17 @@ package ftpd
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,6 +20,15 @@ var (
 	attributeUserArgument = "user-argument"
 	attributeDataType     = "data-type"
 	attributeRenameFrom   = "rename-from"
+	attributeEpsvAll      = "epsv-all"
+	attributePbsz         = "pbsz"
+	attributeProt         = "prot"
+	attributeRestOffset   = "rest-offset"
+	attributeMlstFacts    = "mlst-facts"
+	attributeHash         = "hash"
+	attributeRange        = "range"
+	protClear             = "C"
+	protPrivate           = "P"
 	dataTypeAscii         = "ASCII"
 	dataTypeBinary        = "Binary"
 )
@@ -27,6 +39,7 @@ type FtpSession struct {
 	CtrlWriter *bufio.Writer
 	DataConn   DataConn
 
+	ID         string
 	FtpServer  *FtpServer
 	FtpUser    *FtpUser
 	RemoteAddr net.Addr
@@ -39,17 +52,36 @@ type FtpSession struct {
 	CurrentDir string
 
 	Attribute map[string]string
+
+	// 保护其他会话可能读取的状态, 见 FtpServer.Sessions
+	mutex    sync.Mutex
+	request  *FtpRequest
+	transfer *transfer
+	// 正在执行命令, 服务器关闭时会等待命令执行完毕
+	busy bool
+	// 已被服务器关闭
+	closed bool
+
+	// 为 localFsUser 创建的本地文件系统, 见 fileSystem
+	localFs     *LocalFileSystem
+	localFsUser *FtpUser
 }
 
 func (session *FtpSession) handler() {
+	defer session.FtpServer.wg.Done()
 
 	session.write(reply220ServiceReady, defaultWelcomeMessage)
 
 	log.Printf("[%s] =====[+++]=====", session.RemoteAddr)
 
-	for {
+	for session.idle() {
+		message := session.setCtrlDeadline()
 		line, err := session.CtrlReader.ReadString('\n')
-		if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			session.closeWith421(message)
+			break
+		}
+		if err != nil || !session.begin() {
 			break
 		}
 		session.interpreter(line)
@@ -57,6 +89,7 @@ func (session *FtpSession) handler() {
 
 	// 关闭FTP连接
 	session.Close()
+	session.FtpServer.removeSession(session)
 
 	// 断开连接时通知监听器
 	session.FtpServer.onDisconnect(session)
@@ -64,23 +97,137 @@ func (session *FtpSession) handler() {
 	log.Printf("[%s] =====[!!!]=====", session.RemoteAddr)
 }
 
-func (session *FtpSession) interpreter(line string) {
+// 开始执行命令, 会话已被关闭时返回false
+func (session *FtpSession) begin() bool {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	if session.closed {
+		return false
+	}
+	session.busy = true
+	return true
+}
+
+// 命令执行完毕, 进入等待下一个命令的状态. 服务器正在关闭时发送421并返回false
+func (session *FtpSession) idle() bool {
+	shutdown := session.FtpServer.shuttingDown()
+
+	session.mutex.Lock()
+
+	session.busy = false
+	if session.closed {
+		session.mutex.Unlock()
+		return false
+	}
+	if shutdown {
+		session.closed = true
+		session.mutex.Unlock()
+		session.write421("Service not available, closing control connection.")
+		return false
+	}
+	session.mutex.Unlock()
+	return true
+}
+
+// 设置控制通道等待下一个命令的超时时间, 未登录时不超过登录期限. 返回超时后发送给客户端的信息
+func (session *FtpSession) setCtrlDeadline() string {
+	opt := session.FtpServer.opt
+
+	var deadline time.Time
+	message := ""
+	if idle := timeoutOrDefault(opt.IdleTimeout, defaultIdleTimeout); idle > 0 {
+		deadline = time.Now().Add(idle)
+		message = fmt.Sprintf("Timeout (no operation for %d seconds).", int(idle.Seconds()))
+	}
+	if login := timeoutOrDefault(opt.LoginTimeout, defaultLoginTimeout); login > 0 && !session.IsLoginedIn {
+		if d := session.ConnectAt.Add(login); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+			message = "Login timeout."
+		}
+	}
+
+	_ = session.CtrlConn.SetReadDeadline(deadline)
+	return message
+}
+
+// 发送421并标记会话已关闭, 会话已被关闭时不再发送
+func (session *FtpSession) closeWith421(message string) {
+	session.mutex.Lock()
+	closed := session.closed
+	session.closed = true
+	session.mutex.Unlock()
+
+	if !closed {
+		session.write421(message)
+	}
+}
+
+// 发送421. 调用者需要先把会话标记为已关闭, 发送时不持有锁, 并设置写超时,
+// 不读取数据的客户端不会阻塞服务器关闭
+func (session *FtpSession) write421(message string) {
+	_ = session.CtrlConn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	session.write(reply421ServiceNotAvailableClosingControlConnection, message)
+}
+
+// 会话空闲时发送421并关闭控制通道, 会话已关闭时返回true
+func (session *FtpSession) closeIfIdle() bool {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return true
+	}
+	if session.busy {
+		session.mutex.Unlock()
+		return false
+	}
+	session.closed = true
+	session.mutex.Unlock()
+
+	// 会话空闲时处理goroutine阻塞在读取命令上, 不会同时写控制通道
+	s := session.FtpServer
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		session.write421("Service not available, closing control connection.")
+		_ = session.CtrlConn.Close()
+	}()
+	return true
+}
 
-	session.LastAccessAt = time.Now()
+// 强制关闭控制通道和正在传输的数据通道
+func (session *FtpSession) forceClose() {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	session.closed = true
+	if session.transfer != nil && session.transfer.conn != nil {
+		_ = session.transfer.conn.Close()
+	}
+	_ = session.CtrlConn.Close()
+}
+
+func (session *FtpSession) interpreter(line string) {
 
 	request := parseLine(line)
 
+	session.mutex.Lock()
+	session.LastAccessAt = request.ReceivedAt
+	session.mutex.Unlock()
+	session.request = request
+
 	log.Printf("[%s] >>> %s", session.RemoteAddr, request.Line)
 
+	c := session.FtpServer.LookupCommand(request.Command)
+
 	// 判断该命令是否是需要权限认证的命令
-	if !session.IsLoginedIn && !isWithoutAuthenticationCommand(request.Command) {
+	if !session.IsLoginedIn && (c == nil || commandRequireAuth(c)) {
 		session.write(reply530NotLoggedIn, "Access denied")
 		return
 	}
 
 	// 判断命令是否存在
-	c := commands[request.Command]
-	if c == nil {
+	if c == nil || !commandEnabled(session, c) {
 		session.write(reply502CommandNotImplemented, "Command not implemented")
 		return
 	}
@@ -135,15 +282,184 @@ func (session *FtpSession) CloseDataConn() {
 	}
 }
 
-func (session *FtpSession) buildPath(path string) (string, os.FileInfo, error) {
+// 控制通道是否已经通过 AUTH TLS 加密
+func (session *FtpSession) isSecure() bool {
+	_, ok := session.CtrlConn.(*tls.Conn)
+	return ok
+}
 
-	abspath, sandpath := session.getFilePath(path)
+// 将控制通道升级为TLS连接, 之后的命令和应答都经过加密
+func (session *FtpSession) upgradeTLS(config *tls.Config) error {
+	conn := tls.Server(session.CtrlConn, config)
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+
+	session.mutex.Lock()
+	session.CtrlConn = conn
+	session.CtrlReader = bufio.NewReader(conn)
+	session.CtrlWriter = bufio.NewWriter(conn)
+	session.mutex.Unlock()
+	return nil
+}
 
-	info, err := os.Stat(abspath)
-	return sandpath, info, err
+// PROT P 时返回数据通道使用的TLS配置, 否则返回nil
+func (session *FtpSession) dataTLSConfig() *tls.Config {
+	if session.getAttribute(attributeProt) != protPrivate {
+		return nil
+	}
+	return session.FtpServer.opt.TLSConfig
 }
 
-func (session *FtpSession) getFilePath(path string) (string, string) {
+// 主动模式: 连接客户端指定的地址作为数据通道, 失败时向客户端返回错误信息
+func (session *FtpSession) openPortConn(addr *net.TCPAddr) bool {
+	// TODO 判断是否开启被动模式IP检查再决定是否检查IP地址
+	if n, ok := session.RemoteAddr.(*net.TCPAddr); ok {
+		if !addr.IP.Equal(n.IP) {
+			session.write(reply501SyntaxErrorInParametersOrArguments, "Syntax error in parameters or arguments.")
+			return false
+		}
+	}
+
+	opt := session.FtpServer.opt
+	conn, err := newPortModeConn(addr, session.dataConnTimeout(), timeoutOrDefault(opt.DataTimeout, defaultDataTimeout), session.dataTLSConfig())
+	if err != nil {
+		log.Print(err)
+		session.write(reply425CantOpenDataConnection, "Can't open data connection.")
+		return false
+	}
+
+	session.CloseDataConn()
+	session.DataConn = conn
+
+	log.Printf("[%s] Enable PORT Mode, Destination: %s", session.RemoteAddr, addr)
+	return true
+}
+
+// 被动模式: 在控制通道的本地地址上监听数据通道, 失败时向客户端返回错误信息
+func (session *FtpSession) openPasvConn() *pasvModeConn {
+	opt := session.FtpServer.opt
+
+	// 控制通道不是TCP连接(如自定义的监听器)时无法确定数据通道的地址
+	local, ok := session.LocalAddr.(*net.TCPAddr)
+	if !ok {
+		session.write(reply425CantOpenDataConnection, "Can't open data connection.")
+		return nil
+	}
+	remote, ok := session.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		session.write(reply425CantOpenDataConnection, "Can't open data connection.")
+		return nil
+	}
+	conn, err := newPasvModeConn(local.IP, opt.PasvMinPort, opt.PasvMaxPort, remote,
+		session.dataConnTimeout(), timeoutOrDefault(opt.DataTimeout, defaultDataTimeout), session.dataTLSConfig())
+	if err != nil {
+		log.Print(err)
+		session.write(reply425CantOpenDataConnection, "Can't open data connection.")
+		return nil
+	}
+
+	session.CloseDataConn()
+	session.DataConn = conn
+
+	log.Printf("[%s] Enable PASV Mode, Listen: %s", session.RemoteAddr, conn.Addr())
+	return conn
+}
+
+// 建立数据通道的超时时间
+func (session *FtpSession) dataConnTimeout() time.Duration {
+	return timeoutOrDefault(session.FtpServer.opt.DataConnTimeout, defaultDataConnTimeout)
+}
+
+// 数据通道出错时中止传输, 超时时说明原因
+func (session *FtpSession) abortTransfer(err error) {
+	log.Print(err)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		session.write(reply426ConnectionClosedTransferAborted, "Data connection timed out; transfer aborted.")
+	} else {
+		session.write(reply426ConnectionClosedTransferAborted, "Connection closed; transfer aborted.")
+	}
+	session.CloseDataConn()
+}
+
+// 取出 REST 命令设置的偏移量, 偏移量只对紧接着的一次传输有效
+func (session *FtpSession) takeRestOffset() int64 {
+	offset, _ := strconv.ParseInt(session.getAttribute(attributeRestOffset), 10, 64)
+	session.removeAttribute(attributeRestOffset)
+	return offset
+}
+
+// 取出 RANG 或 REST 设置的范围, end为-1时表示到文件末尾, 范围只对紧接着的一次操作有效
+func (session *FtpSession) takeRange() (int64, int64) {
+	start, end := session.takeRestOffset(), int64(-1)
+	if r := session.getAttribute(attributeRange); r != "" {
+		_, _ = fmt.Sscanf(r, "%d %d", &start, &end)
+		session.removeAttribute(attributeRange)
+	}
+	return start, end
+}
+
+var errRangeExceeded = errors.New("data exceeds range")
+
+// 限制上传写入的字节数, 超出 RANG 指定的范围时返回 errRangeExceeded
+type rangeWriter struct {
+	io.WriteCloser
+	remain int64
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remain {
+		n, err := w.WriteCloser.Write(p[:w.remain])
+		w.remain -= int64(n)
+		if err == nil {
+			err = errRangeExceeded
+		}
+		return n, err
+	}
+	n, err := w.WriteCloser.Write(p)
+	w.remain -= int64(n)
+	return n, err
+}
+
+// HASH 命令当前使用的算法
+func (session *FtpSession) hashAlgorithm() *hashAlgorithm {
+	if algo := findHashAlgorithm(session.getAttribute(attributeHash)); algo != nil {
+		return algo
+	}
+	return findHashAlgorithm(defaultHashAlgorithm)
+}
+
+// MLST/MLSD 返回的事实, 未通过 OPTS MLST 选择时返回全部事实
+func (session *FtpSession) mlstFacts() []string {
+	facts, ok := session.Attribute[attributeMlstFacts]
+	if !ok {
+		return mlstFacts
+	}
+	if facts == "" {
+		return nil
+	}
+	return strings.Split(facts, ";")
+}
+
+// 当前用户使用的文件系统
+func (session *FtpSession) fileSystem() FileSystem {
+	if session.FtpUser.FileSystem != nil {
+		return session.FtpUser.FileSystem
+	}
+	// 同一个用户复用本地文件系统, Root只在第一次使用时解析
+	if session.localFs != nil && session.localFsUser == session.FtpUser {
+		return session.localFs
+	}
+	session.localFsUser = session.FtpUser
+	session.localFs = &LocalFileSystem{
+		Root:           session.FtpUser.HomeDir,
+		Symlinks:       session.FtpUser.SymlinkPolicy,
+		SymlinkTargets: session.FtpUser.SymlinkTargets,
+	}
+	return session.localFs
+}
+
+func (session *FtpSession) getFilePath(path string) string {
 	// 逻辑路径(即: FTP用户所看到的绝对路径)
 	sandpath := session.CurrentDir
 	if len(path) > 0 {
@@ -155,19 +471,29 @@ func (session *FtpSession) getFilePath(path string) (string, string) {
 	}
 
 	// Windows下的路径分割符是 '\' 要转义成 '/'
-	abspath := filepath.Join(session.FtpUser.HomeDir, sandpath)
-	sandpath = strings.Replace(sandpath, string(filepath.Separator), "/", -1)
-
-	return abspath, sandpath
+	return strings.Replace(sandpath, string(filepath.Separator), "/", -1)
 }
 
 // 向控制通道写入返回信息
-func (session FtpSession) write(reply int, message string) {
-	msg := fmt.Sprintf("%d %s\n", reply, message)
-	_, err := session.CtrlWriter.WriteString(msg)
-	if err == nil {
-		_ = session.CtrlWriter.Flush()
+func (session *FtpSession) write(reply int, message string) {
+	_ = session.Reply(NewFtpReply(reply, message))
+}
+
+// 向控制通道写入多行返回信息, 中间行以空格开头
+func (session *FtpSession) writeLines(reply int, first string, lines []string, last string) {
+	all := make([]string, 0, len(lines)+2)
+	all = append(all, first)
+	all = append(all, lines...)
+	all = append(all, last)
+	_ = session.Reply(NewFtpReply(reply, all...))
+}
+
+// Reply 向控制通道发送应答, 供自定义命令使用
+func (session *FtpSession) Reply(reply *FtpReply) error {
+	if _, err := session.CtrlWriter.WriteString(reply.String()); err != nil {
+		return err
 	}
+	return session.CtrlWriter.Flush()
 }
 
 // 往数据通道写入数据
@@ -179,9 +505,15 @@ func (session *FtpSession) writeData(data []byte) {
 		return
 	}
 
+	t := session.beginTransfer()
+	defer session.endTransfer()
+
 	// 向数据通道写入数据
-	if _, err := session.DataConn.Write(data); err != nil {
-		log.Print(err)
+	n, err := session.DataConn.Write(data)
+	atomic.AddInt64(&t.bytes, int64(n))
+	if err != nil {
+		session.abortTransfer(err)
+		return
 	}
 
 	message := "Closing data connection, sent " + strconv.Itoa(len(data)) + " bytes"
@@ -199,7 +531,14 @@ func (session *FtpSession) writeFile(data io.ReadCloser) {
 		return
 	}
 
-	sz, _ := io.Copy(session.DataConn, data)
+	t := session.beginTransfer()
+	defer session.endTransfer()
+
+	sz, err := io.Copy(session.DataConn, &countingReader{r: data, n: &t.bytes})
+	if err != nil {
+		session.abortTransfer(err)
+		return
+	}
 
 	message := "Closing data connection, sent " + strconv.FormatInt(sz, 10) + " bytes"
 	session.write(reply226ClosingDataConnection, message)
@@ -207,3 +546,39 @@ func (session *FtpSession) writeFile(data io.ReadCloser) {
 	// 完毕后关闭数据通道
 	session.CloseDataConn()
 }
+
+// 从数据通道接收数据写入file, name不为空时在回复中告知客户端实际保存的文件名
+func (session *FtpSession) readFile(file io.WriteCloser, name string) {
+
+	t := session.beginTransfer()
+	defer session.endTransfer()
+
+	r := &countingReader{r: session.DataConn, n: &t.bytes}
+	sz, err := io.Copy(file, r)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if r.err != nil {
+		// 数据通道出错
+		session.abortTransfer(r.err)
+		return
+	}
+	if err == errQuotaExceeded {
+		session.write(reply552RequestedFileActionAbortedExceededStorage, "Exceeded storage allocation.")
+	} else if err == errRangeExceeded {
+		session.write(reply551RequestedActionAbortedPageTypeUnknown, "Data exceeds the requested range.")
+	} else if err != nil {
+		log.Print(err)
+		session.write(reply551RequestedActionAbortedPageTypeUnknown, "Error on input file.")
+	} else {
+		message := "Closing data connection, sent " + strconv.FormatInt(sz, 10) + " bytes"
+		if name != "" {
+			message += ", FILE: " + name
+		}
+		session.write(reply226ClosingDataConnection, message)
+	}
+
+	// 完毕后关闭数据通道
+	session.CloseDataConn()
+}
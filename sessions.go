@@ -0,0 +1,169 @@
+package ftpd
+
+import (
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo 是会话状态的快照, 由 FtpServer.Sessions 返回
+type SessionInfo struct {
+	ID           string
+	Username     string
+	RemoteAddr   net.Addr
+	ConnectAt    time.Time
+	LastAccessAt time.Time
+	CurrentDir   string
+	// 没有正在进行的数据传输时为nil
+	Transfer *TransferInfo
+}
+
+// TransferInfo 描述正在进行的数据传输
+type TransferInfo struct {
+	Command  string
+	Argument string
+	StartAt  time.Time
+	// 已传输的字节数
+	Bytes int64
+}
+
+// 正在进行的数据传输, bytes 在传输过程中原子更新
+type transfer struct {
+	bytes    int64
+	command  string
+	argument string
+	startAt  time.Time
+	// 服务器关闭时用于中断传输
+	conn DataConn
+}
+
+// 统计读取字节数的Reader, 并记录读取时发生的错误
+type countingReader struct {
+	r   io.Reader
+	n   *int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
+
+// 当前所有会话, 返回后不再持有 s.mutex
+func (s *FtpServer) sessionList() []*FtpSession {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sessions := make([]*FtpSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Sessions 返回当前所有会话的快照, 按连接时间排序
+func (s *FtpServer) Sessions() []SessionInfo {
+	sessions := s.sessionList()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ConnectAt.Equal(infos[j].ConnectAt) {
+			// ID 是递增的序号, 按数值比较
+			a, _ := strconv.ParseUint(infos[i].ID, 10, 64)
+			b, _ := strconv.ParseUint(infos[j].ID, 10, 64)
+			return a < b
+		}
+		return infos[i].ConnectAt.Before(infos[j].ConnectAt)
+	})
+	return infos
+}
+
+// 调用者需要持有 s.mutex
+func (s *FtpServer) addSession(session *FtpSession) {
+	if s.sessions == nil {
+		s.sessions = make(map[string]*FtpSession)
+	}
+	s.sessions[session.ID] = session
+
+	if s.ipSessions == nil {
+		s.ipSessions = make(map[string]int)
+	}
+	s.ipSessions[remoteIP(session.RemoteAddr)]++
+}
+
+func (s *FtpServer) removeSession(session *FtpSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.sessions[session.ID]; !ok {
+		return
+	}
+	delete(s.sessions, session.ID)
+	if session.FtpUser != nil && session.FtpUser.Anonymous {
+		s.anonymousSessions--
+	}
+
+	ip := remoteIP(session.RemoteAddr)
+	if s.ipSessions[ip]--; s.ipSessions[ip] <= 0 {
+		delete(s.ipSessions, ip)
+	}
+}
+
+// 生成服务器内唯一的会话ID
+func (s *FtpServer) nextSessionID() string {
+	return strconv.FormatUint(atomic.AddUint64(&s.sessionSeq, 1), 10)
+}
+
+func (session *FtpSession) info() SessionInfo {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+
+	info := SessionInfo{
+		ID:           session.ID,
+		RemoteAddr:   session.RemoteAddr,
+		ConnectAt:    session.ConnectAt,
+		LastAccessAt: session.LastAccessAt,
+		CurrentDir:   session.CurrentDir,
+	}
+	if session.IsLoginedIn && session.FtpUser != nil {
+		info.Username = session.FtpUser.Username
+	}
+	if t := session.transfer; t != nil {
+		info.Transfer = &TransferInfo{
+			Command:  t.command,
+			Argument: t.argument,
+			StartAt:  t.startAt,
+			Bytes:    atomic.LoadInt64(&t.bytes),
+		}
+	}
+	return info
+}
+
+// 开始一次数据传输, 记录当前执行的命令
+func (session *FtpSession) beginTransfer() *transfer {
+	t := &transfer{startAt: time.Now(), conn: session.DataConn}
+	if session.request != nil {
+		t.command = session.request.Command
+		t.argument = session.request.Argument
+	}
+
+	session.mutex.Lock()
+	session.transfer = t
+	session.mutex.Unlock()
+	return t
+}
+
+func (session *FtpSession) endTransfer() {
+	session.mutex.Lock()
+	session.transfer = nil
+	session.mutex.Unlock()
+}
@@ -0,0 +1,232 @@
+package ftpd
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SQLUserSchema 是 SQLUserManager 使用的表结构(SQLite语法, 也适用于大多数数据库).
+// 权限是 ParsePermission 支持的权限名, 为空时使用组的权限, 都为空时只读.
+// 用户的配额列为NULL时使用组的 default_user_quota_* 列, 这是组内每个用户各自的默认配额, 不在组内共享,
+// 同组用户共享的配额通过 FtpServerOpt.GroupQuotas 设置.
+// ftp_path_permissions 中的一行属于一个用户或一个组, 同一路径上用户的设置优先
+const SQLUserSchema = `CREATE TABLE IF NOT EXISTS ftp_groups (
+	name                      VARCHAR(64) PRIMARY KEY,
+	permissions               VARCHAR(255) NOT NULL DEFAULT '',
+	default_user_quota_bytes  BIGINT,
+	default_user_quota_files  BIGINT,
+	default_user_quota_policy VARCHAR(16)
+);
+CREATE TABLE IF NOT EXISTS ftp_users (
+	username        VARCHAR(64) PRIMARY KEY,
+	password        VARCHAR(255) NOT NULL,
+	home_dir        VARCHAR(1024) NOT NULL DEFAULT '',
+	group_name      VARCHAR(64) REFERENCES ftp_groups (name),
+	permissions     VARCHAR(255) NOT NULL DEFAULT '',
+	quota_bytes     BIGINT,
+	quota_files     BIGINT,
+	quota_policy    VARCHAR(16),
+	last_login_at   TIMESTAMP,
+	last_failed_at  TIMESTAMP,
+	failed_attempts INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS ftp_path_permissions (
+	username    VARCHAR(64) REFERENCES ftp_users (username),
+	group_name  VARCHAR(64) REFERENCES ftp_groups (name),
+	path        VARCHAR(1024) NOT NULL,
+	permissions VARCHAR(255) NOT NULL
+)`
+
+// 使用 $1, $2 作为占位符的驱动
+var dollarPlaceholderDrivers = map[string]bool{
+	"postgres": true,
+	"pgx":      true,
+}
+
+// SQLUserManager 是从SQL数据库读取用户和组的 FtpUserManager, 通过 database/sql 访问数据库,
+// 驱动需要由使用者导入, 如 github.com/mattn/go-sqlite3. 表结构见 SQLUserSchema.
+// 登录成功时更新 last_login_at 并清零 failed_attempts, 失败时增加 failed_attempts
+type SQLUserManager struct {
+	// 没有设置主目录的用户使用 DefaultHomeDir 下以用户名命名的目录, DefaultHomeDir 为空时这些用户不能登录
+	DefaultHomeDir string
+	// 连续登录失败的次数达到上限后拒绝登录, 直到管理员清零 failed_attempts. 0表示不限制
+	MaxFailedAttempts int
+
+	db     *sql.DB
+	dollar bool
+}
+
+// NewSQLUserManager 使用已注册的驱动和DSN打开数据库, 如 NewSQLUserManager("sqlite3", "users.db")
+func NewSQLUserManager(driverName, dsn string) (*SQLUserManager, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &SQLUserManager{db: db, dollar: dollarPlaceholderDrivers[driverName]}, nil
+}
+
+// DB 返回使用的数据库连接
+func (m *SQLUserManager) DB() *sql.DB {
+	return m.db
+}
+
+func (m *SQLUserManager) Close() error {
+	return m.db.Close()
+}
+
+// CreateSchema 创建 SQLUserSchema 中不存在的表
+func (m *SQLUserManager) CreateSchema() error {
+	for _, stmt := range strings.Split(SQLUserSchema, ";") {
+		if _, err := m.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 把 ? 占位符转换成驱动使用的格式
+func (m *SQLUserManager) rebind(query string) string {
+	if !m.dollar {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// 用户或组的配额列, 空间和文件数都为NULL时表示没有设置配额
+type sqlQuota struct {
+	bytes  sql.NullInt64
+	files  sql.NullInt64
+	policy sql.NullString
+}
+
+func (q *sqlQuota) record() *quotaRecord {
+	if !q.bytes.Valid && !q.files.Valid {
+		return nil
+	}
+	return &quotaRecord{MaxBytes: q.bytes.Int64, MaxFiles: q.files.Int64, Policy: q.policy.String}
+}
+
+// 用户和所属组的一行数据
+type sqlUserRow struct {
+	password       string
+	homeDir        string
+	group          sql.NullString
+	permissions    string
+	groupPerms     sql.NullString
+	quota          sqlQuota
+	defaultQuota   sqlQuota
+	failedAttempts int
+}
+
+func (m *SQLUserManager) Authenticate(username, password string) (*FtpUser, error) {
+	var row sqlUserRow
+	err := m.db.QueryRow(m.rebind(`SELECT u.password, u.home_dir, u.group_name, u.permissions, g.permissions,
+	u.quota_bytes, u.quota_files, u.quota_policy,
+	g.default_user_quota_bytes, g.default_user_quota_files, g.default_user_quota_policy, u.failed_attempts
+FROM ftp_users u LEFT JOIN ftp_groups g ON g.name = u.group_name
+WHERE u.username = ?`), username).Scan(&row.password, &row.homeDir, &row.group, &row.permissions, &row.groupPerms,
+		&row.quota.bytes, &row.quota.files, &row.quota.policy,
+		&row.defaultQuota.bytes, &row.defaultQuota.files, &row.defaultQuota.policy,
+		&row.failedAttempts)
+	if err == sql.ErrNoRows {
+		// 用户不存在时也计算一次哈希, 避免通过响应时间判断用户是否存在
+		_, _ = checkPassword(dummyPasswordHash, password)
+		return nil, ErrAuthenticationFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := checkPassword(row.password, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || (m.MaxFailedAttempts > 0 && row.failedAttempts >= m.MaxFailedAttempts) {
+		if _, err := m.db.Exec(m.rebind(`UPDATE ftp_users SET failed_attempts = failed_attempts + 1, last_failed_at = ?
+WHERE username = ?`), time.Now().UTC(), username); err != nil {
+			return nil, err
+		}
+		return nil, ErrAuthenticationFailed
+	}
+
+	user, err := m.user(username, &row)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := m.db.Exec(m.rebind(`UPDATE ftp_users SET last_login_at = ?, failed_attempts = 0
+WHERE username = ?`), time.Now().UTC(), username); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (m *SQLUserManager) user(username string, row *sqlUserRow) (*FtpUser, error) {
+	home, err := userHomeDir(row.homeDir, m.DefaultHomeDir, username)
+	if err != nil {
+		return nil, err
+	}
+	record := userRecord{
+		Username:    username,
+		Password:    row.password,
+		HomeDir:     home,
+		Group:       row.group.String,
+		Permissions: row.permissions,
+	}
+	if record.Permissions == "" {
+		record.Permissions = row.groupPerms.String
+	}
+
+	if record.Quota = row.quota.record(); record.Quota == nil {
+		record.Quota = row.defaultQuota.record()
+	}
+
+	// 组的设置只取不属于任何用户的行, 没有组时 group_name = NULL 不匹配任何行
+	rows, err := m.db.Query(m.rebind(`SELECT path, permissions, username FROM ftp_path_permissions
+WHERE username = ? OR (username IS NULL AND group_name = ?)`), username, row.group)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	userPaths := make(map[string]bool)
+	for rows.Next() {
+		var path, perm string
+		var owner sql.NullString
+		if err := rows.Scan(&path, &perm, &owner); err != nil {
+			return nil, err
+		}
+		if record.PathPermissions == nil {
+			record.PathPermissions = make(map[string]string)
+		}
+		if owner.Valid {
+			record.PathPermissions[path] = perm
+			userPaths[path] = true
+		} else if !userPaths[path] {
+			record.PathPermissions[path] = perm
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	u, err := record.storedUser()
+	if err != nil {
+		return nil, err
+	}
+	return &u.user, nil
+}
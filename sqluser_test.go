@@ -0,0 +1,140 @@
+//go:build cgo
+// +build cgo
+
+package ftpd
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestSQLUserManager(t *testing.T) *SQLUserManager {
+	m, err := NewSQLUserManager("sqlite3", filepath.Join(tempDir(t), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	if err := m.CreateSchema(); err != nil {
+		t.Fatal(err)
+	}
+	// 重复创建不报错
+	if err := m.CreateSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stmt := range []string{
+		`INSERT INTO ftp_groups (name, permissions, default_user_quota_bytes, default_user_quota_files) VALUES ('staff', 'readonly', 1024, 10)`,
+		`INSERT INTO ftp_users (username, password, group_name) VALUES ('alice', '{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=', 'staff')`,
+		`INSERT INTO ftp_users (username, password, home_dir, group_name, permissions, quota_bytes, quota_policy)
+			VALUES ('bob', '` + bcryptHash(t, "secret") + `', '/srv/bob', 'staff', 'all', 2048, 'keep')`,
+		`INSERT INTO ftp_users (username, password) VALUES ('carol', '$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5')`,
+		`INSERT INTO ftp_path_permissions (group_name, path, permissions) VALUES ('staff', '/shared', 'list,read,write')`,
+		`INSERT INTO ftp_path_permissions (group_name, path, permissions) VALUES ('staff', '/private', '')`,
+		`INSERT INTO ftp_path_permissions (username, path, permissions) VALUES ('bob', '/shared', 'all')`,
+		`INSERT INTO ftp_path_permissions (username, group_name, path, permissions) VALUES ('bob', 'staff', '/bob', 'all')`,
+	} {
+		if _, err := m.DB().Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func TestSQLUserManager(t *testing.T) {
+	m := newTestSQLUserManager(t)
+	// 没有主目录的用户不能登录
+	if _, err := m.Authenticate("carol", "Hello world!"); err != ErrNoHomeDir {
+		t.Fatalf("user without home: %v", err)
+	}
+	m.DefaultHomeDir = "/srv/ftp"
+
+	alice, err := m.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.HomeDir != filepath.Join("/srv/ftp", "alice") || alice.Group != "staff" || alice.Permissions != PermReadOnly ||
+		alice.PathPermissions["/shared"] != PermList|PermRead|PermWrite || alice.PathPermissions["/private"] != 0 ||
+		len(alice.PathPermissions) != 2 {
+		t.Fatalf("alice = %+v", alice)
+	}
+	if *alice.Quota != (Quota{MaxBytes: 1024, MaxFiles: 10}) {
+		t.Fatalf("alice quota = %+v", *alice.Quota)
+	}
+
+	// 用户自己的设置覆盖组的设置
+	bob, err := m.Authenticate("bob", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.HomeDir != "/srv/bob" || bob.Permissions != PermAll || bob.PathPermissions["/shared"] != PermAll {
+		t.Fatalf("bob = %+v", bob)
+	}
+	if *bob.Quota != (Quota{MaxBytes: 2048, Policy: QuotaKeepPartial}) {
+		t.Fatalf("bob quota = %+v", *bob.Quota)
+	}
+
+	carol, err := m.Authenticate("carol", "Hello world!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有组也没有设置权限的用户只读
+	if carol.Group != "" || carol.Permissions != PermReadOnly || !carol.PermissionsSet || carol.Quota != nil ||
+		len(carol.PathPermissions) != 0 {
+		t.Fatalf("carol = %+v", carol)
+	}
+
+	if _, err := m.Authenticate("dave", "secret"); err != ErrAuthenticationFailed {
+		t.Fatalf("unknown user: %v", err)
+	}
+}
+
+func TestSQLUserManagerCounters(t *testing.T) {
+	m := newTestSQLUserManager(t)
+	m.DefaultHomeDir = "/srv/ftp"
+	m.MaxFailedAttempts = 2
+
+	counters := func() (int, bool, bool) {
+		var failed int
+		var lastLogin, lastFailed sql.NullTime
+		err := m.DB().QueryRow(`SELECT failed_attempts, last_login_at, last_failed_at FROM ftp_users WHERE username = 'alice'`).
+			Scan(&failed, &lastLogin, &lastFailed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return failed, lastLogin.Valid, lastFailed.Valid
+	}
+
+	if _, err := m.Authenticate("alice", "wrong"); err != ErrAuthenticationFailed {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if failed, login, lastFailed := counters(); failed != 1 || login || !lastFailed {
+		t.Fatalf("failed = %d, login = %v, lastFailed = %v", failed, login, lastFailed)
+	}
+	if _, err := m.Authenticate("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if failed, login, _ := counters(); failed != 0 || !login {
+		t.Fatalf("after login: failed = %d, login = %v", failed, login)
+	}
+
+	// 达到失败次数上限后正确的密码也不能登录
+	for i := 0; i < 2; i++ {
+		_, _ = m.Authenticate("alice", "wrong")
+	}
+	if _, err := m.Authenticate("alice", "secret"); err != ErrAuthenticationFailed {
+		t.Fatalf("locked user: %v", err)
+	}
+	if failed, _, _ := counters(); failed != 3 {
+		t.Fatalf("failed = %d", failed)
+	}
+}
+
+func TestSQLUserManagerRebind(t *testing.T) {
+	m := &SQLUserManager{dollar: true}
+	if got := m.rebind("UPDATE t SET a = ? WHERE b = ?"); got != "UPDATE t SET a = $1 WHERE b = $2" {
+		t.Fatalf("rebind = %s", got)
+	}
+}
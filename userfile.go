@@ -0,0 +1,256 @@
+package ftpd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// 用户文件中的一个用户, 密码是哈希值, 权限是 ParsePermission 支持的权限名, 为空时只读
+type userRecord struct {
+	Username        string            `json:"username" yaml:"username"`
+	Password        string            `json:"password" yaml:"password"`
+	HomeDir         string            `json:"home" yaml:"home"`
+	Permissions     string            `json:"permissions" yaml:"permissions"`
+	PathPermissions map[string]string `json:"path_permissions" yaml:"path_permissions"`
+	Group           string            `json:"group" yaml:"group"`
+	Quota           *quotaRecord      `json:"quota" yaml:"quota"`
+}
+
+type quotaRecord struct {
+	MaxBytes int64  `json:"max_bytes" yaml:"max_bytes"`
+	MaxFiles int64  `json:"max_files" yaml:"max_files"`
+	Policy   string `json:"policy" yaml:"policy"`
+}
+
+// JSON/YAML 用户文件的格式
+type userFile struct {
+	Users []userRecord `json:"users" yaml:"users"`
+}
+
+// 加载后的用户, 登录时复制一份返回给会话
+type storedUser struct {
+	password string
+	user     FtpUser
+}
+
+func (r *userRecord) storedUser() (*storedUser, error) {
+	if r.Username == "" {
+		return nil, errors.New("empty username")
+	}
+	// 用户名会作为默认主目录下的目录名
+	if strings.ContainsAny(r.Username, `/\`) || strings.Contains(r.Username, "..") {
+		return nil, fmt.Errorf("invalid username %q", r.Username)
+	}
+	if err := checkPasswordHash(r.Password); err != nil {
+		return nil, fmt.Errorf("user %s: %v", r.Username, err)
+	}
+
+	perm := PermReadOnly
+	if r.Permissions != "" {
+		var err error
+		if perm, err = ParsePermission(r.Permissions); err != nil {
+			return nil, fmt.Errorf("user %s: %v", r.Username, err)
+		}
+	}
+	u := &storedUser{
+		password: r.Password,
+		user: FtpUser{
+			Username:       r.Username,
+			HomeDir:        r.HomeDir,
+			Permissions:    perm,
+			PermissionsSet: true,
+			Group:          r.Group,
+		},
+	}
+
+	if len(r.PathPermissions) > 0 {
+		u.user.PathPermissions = make(map[string]Permission, len(r.PathPermissions))
+		for path, s := range r.PathPermissions {
+			var err error
+			if u.user.PathPermissions[path], err = ParsePermission(s); err != nil {
+				return nil, fmt.Errorf("user %s: %s: %v", r.Username, path, err)
+			}
+		}
+	}
+
+	if q := r.Quota; q != nil {
+		policy, err := parseQuotaPolicy(q.Policy)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %v", r.Username, err)
+		}
+		u.user.Quota = &Quota{MaxBytes: q.MaxBytes, MaxFiles: q.MaxFiles, Policy: policy}
+	}
+	return u, nil
+}
+
+// 用户的主目录, 没有设置时使用 defaultHome 下以用户名命名的目录, 都没有时返回 ErrNoHomeDir
+func userHomeDir(home, defaultHome, username string) (string, error) {
+	if home != "" {
+		return home, nil
+	}
+	if defaultHome == "" {
+		return "", ErrNoHomeDir
+	}
+	return filepath.Join(defaultHome, username), nil
+}
+
+// Apache htpasswd 格式, 每行一个 用户名:密码哈希, #开头的行是注释
+func parseHtpasswd(data []byte) ([]userRecord, error) {
+	var records []userRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(text, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: invalid htpasswd entry", line)
+		}
+		records = append(records, userRecord{Username: text[:i], Password: text[i+1:]})
+	}
+	return records, scanner.Err()
+}
+
+// 按扩展名解析用户文件, .json 和 .yaml/.yml 之外的文件按 htpasswd 格式解析
+func parseUserFile(path string, data []byte) (map[string]*storedUser, error) {
+	var file userFile
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &file)
+	default:
+		file.Users, err = parseHtpasswd(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]*storedUser, len(file.Users))
+	for i := range file.Users {
+		u, err := file.Users[i].storedUser()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := users[u.user.Username]; ok {
+			return nil, fmt.Errorf("duplicate user %s", u.user.Username)
+		}
+		users[u.user.Username] = u
+	}
+	return users, nil
+}
+
+// FileUserManager 是从文件加载用户的 FtpUserManager, 支持JSON、YAML和Apache htpasswd格式.
+// 用户的密码保存为哈希值, 文件修改后在下一次登录时重新加载
+type FileUserManager struct {
+	// 没有设置主目录的用户(如htpasswd中的用户)使用 DefaultHomeDir 下以用户名命名的目录,
+	// DefaultHomeDir 为空时这些用户不能登录
+	DefaultHomeDir string
+
+	path    string
+	mutex   sync.RWMutex
+	users   map[string]*storedUser
+	modTime time.Time
+	size    int64
+}
+
+// NewFileUserManager 加载用户文件, 文件格式由扩展名决定: .json, .yaml/.yml, 其他为htpasswd
+func NewFileUserManager(path string) (*FileUserManager, error) {
+	m := &FileUserManager{path: path}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload 重新加载用户文件, 加载失败时继续使用原来的用户
+func (m *FileUserManager) Reload() error {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+	return m.load(info)
+}
+
+func (m *FileUserManager) load(info os.FileInfo) error {
+	// 先记录文件状态再读取, 读取期间文件被修改时下次登录会再次加载
+	m.mutex.Lock()
+	m.modTime, m.size = info.ModTime(), info.Size()
+	m.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	users, err := parseUserFile(m.path, data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", m.path, err)
+	}
+
+	m.mutex.Lock()
+	m.users = users
+	m.mutex.Unlock()
+	return nil
+}
+
+// 文件的修改时间或大小变化时重新加载
+func (m *FileUserManager) reloadIfChanged() {
+	info, err := os.Stat(m.path)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	m.mutex.RLock()
+	changed := !info.ModTime().Equal(m.modTime) || info.Size() != m.size
+	m.mutex.RUnlock()
+	if !changed {
+		return
+	}
+	if err := m.load(info); err != nil {
+		log.Print(err)
+	}
+}
+
+func (m *FileUserManager) Authenticate(username, password string) (*FtpUser, error) {
+	m.reloadIfChanged()
+
+	m.mutex.RLock()
+	u := m.users[username]
+	m.mutex.RUnlock()
+
+	if u == nil {
+		// 用户不存在时也计算一次哈希, 避免通过响应时间判断用户是否存在
+		_, _ = checkPassword(dummyPasswordHash, password)
+		return nil, ErrAuthenticationFailed
+	}
+	ok, err := checkPassword(u.password, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrAuthenticationFailed
+	}
+
+	user := u.user
+	if user.HomeDir, err = userHomeDir(user.HomeDir, m.DefaultHomeDir, user.Username); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,257 @@
+package ftpd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func argon2idHash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		hash     string
+		password string
+	}{
+		{bcryptHash(t, "secret"), "secret"},
+		{argon2idHash("secret"), "secret"},
+		// openssl passwd 生成
+		{"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "Hello world!"},
+		{"$5$roundstoolow$LBuYKTzKgEAL9lQXxUyCloWaUC0rpDg04n9klCFIGv6", "the minimum number is still observed"},
+		{"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", "Hello world!"},
+		{"$6$rounds=10000$saltsalt$WowrPBpEDVlCoruBosYlrZycTCx3//TyDHYqEhX9DUHHt0XTztUqzQDDUuvUGRA8aUe9p55hcAxeGcu58sm3u.", "secret"},
+		{"$apr1$AbCdEfGh$2wOsaapdMOOqGCB1rvw5a0", "secret"},
+		{"$1$AbCdEfGh$QyJgoJMjznvcm0N4qmqSB.", "secret"},
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"},
+	}
+	for _, tt := range tests {
+		if err := checkPasswordHash(tt.hash); err != nil {
+			t.Errorf("checkPasswordHash(%s) = %v", tt.hash, err)
+		}
+		if ok, err := checkPassword(tt.hash, tt.password); !ok || err != nil {
+			t.Errorf("checkPassword(%s) = %v, %v", tt.hash, ok, err)
+		}
+		if ok, err := checkPassword(tt.hash, tt.password+"x"); ok || err != nil {
+			t.Errorf("checkPassword(%s, wrong) = %v, %v", tt.hash, ok, err)
+		}
+	}
+
+	for _, hash := range []string{
+		"secret", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", "$argon2id$v=19$m=1024$c2FsdA$a2V5",
+		// rounds 不是数字、没有盐、哈希长度或字符错误
+		"$5$rounds=abc$", "$5$rounds=abc$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"$5$$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", "$5$saltstring$5B8vYYiY", "$6$saltstring",
+		"$1$AbCdEfGh$QyJgoJMjznvcm0N4qmqSB!", "$apr1$rounds=5$AbCdEfGh$2wOsaapdMOOqGCB1rvw5a0", "{SHA}", "{SHA}c2VjcmV0",
+	} {
+		if err := checkPasswordHash(hash); err == nil {
+			t.Errorf("checkPasswordHash(%s) = nil", hash)
+		}
+		if ok, _ := checkPassword(hash, "anything"); ok {
+			t.Errorf("checkPassword(%s) = true", hash)
+		}
+	}
+	if ok, err := checkPassword("$5$rounds=abc$", "anything"); ok || err != ErrUnsupportedHash {
+		t.Fatalf("invalid rounds: %v, %v", ok, err)
+	}
+	if _, err := checkPassword("secret", "secret"); err != ErrUnsupportedHash {
+		t.Fatalf("plaintext password: %v", err)
+	}
+}
+
+func writeUserFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestFileUserManagerJSON(t *testing.T) {
+	dir := tempDir(t)
+	path := writeUserFile(t, dir, "users.json", fmt.Sprintf(`{"users": [{
+		"username": "alice",
+		"password": %q,
+		"home": "/srv/alice",
+		"permissions": "list,read,write",
+		"path_permissions": {"/pub": "readonly"},
+		"group": "staff",
+		"quota": {"max_bytes": 1024, "max_files": 10, "policy": "keep"}
+	}]}`, bcryptHash(t, "secret")))
+
+	m, err := NewFileUserManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Authenticate("alice", "wrong"); err != ErrAuthenticationFailed {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if _, err := m.Authenticate("bob", "secret"); err != ErrAuthenticationFailed {
+		t.Fatalf("unknown user: %v", err)
+	}
+
+	user, err := m.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.HomeDir != "/srv/alice" || user.Group != "staff" || user.Password != "" ||
+		user.Permissions != PermList|PermRead|PermWrite || user.PathPermissions["/pub"] != PermReadOnly {
+		t.Fatalf("user = %+v", user)
+	}
+	if *user.Quota != (Quota{MaxBytes: 1024, MaxFiles: 10, Policy: QuotaKeepPartial}) {
+		t.Fatalf("quota = %+v", *user.Quota)
+	}
+
+	// 每次登录返回新的用户
+	other, _ := m.Authenticate("alice", "secret")
+	if other == user {
+		t.Fatal("Authenticate returned a shared user")
+	}
+
+	for _, content := range []string{
+		`{"users": [{"username": "alice", "password": "secret"}]}`,
+		`{"users": [{"username": "alice", "password": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "permissions": "fly"}]}`,
+		`{"users": [{"username": "alice", "passwd": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}]}`,
+		`{"users": [{"username": "../root", "password": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}]}`,
+		`{"users": [{"username": "alice/bob", "password": "{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ="}]}`,
+	} {
+		if _, err := NewFileUserManager(writeUserFile(t, dir, "bad.json", content)); err == nil {
+			t.Errorf("NewFileUserManager(%s) = nil", content)
+		}
+	}
+}
+
+func TestFileUserManagerYAML(t *testing.T) {
+	path := writeUserFile(t, tempDir(t), "users.yml", `
+users:
+  - username: alice
+    password: "`+argon2idHash("secret")+`"
+    permissions: readonly
+    path_permissions:
+      /incoming: write
+  - username: bob
+    password: "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"
+`)
+	m, err := NewFileUserManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有主目录的用户不能登录
+	if _, err := m.Authenticate("bob", "Hello world!"); err != ErrNoHomeDir {
+		t.Fatalf("user without home: %v", err)
+	}
+	m.DefaultHomeDir = "/srv/ftp"
+
+	user, err := m.Authenticate("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Permissions != PermReadOnly || user.PathPermissions["/incoming"] != PermWrite || user.Quota != nil {
+		t.Fatalf("user = %+v", user)
+	}
+	user, err = m.Authenticate("bob", "Hello world!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有设置权限的用户只读
+	if user.HomeDir != filepath.Join("/srv/ftp", "bob") || user.Permissions != PermReadOnly || !user.PermissionsSet {
+		t.Fatalf("user = %+v", user)
+	}
+}
+
+func TestFileUserManagerReload(t *testing.T) {
+	dir := tempDir(t)
+	path := writeUserFile(t, dir, "htpasswd", "# users\nalice:$apr1$AbCdEfGh$2wOsaapdMOOqGCB1rvw5a0\n")
+	m, err := NewFileUserManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.DefaultHomeDir = "/srv/ftp"
+	if _, err := m.Authenticate("alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	touch := func(content string, at time.Time) {
+		writeUserFile(t, dir, "htpasswd", content)
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	touch("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n", time.Now().Add(time.Minute))
+	if _, err := m.Authenticate("alice", "secret"); err != ErrAuthenticationFailed {
+		t.Fatalf("removed user: %v", err)
+	}
+	if _, err := m.Authenticate("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 文件格式错误时继续使用原来的用户
+	touch("bob\n", time.Now().Add(2*time.Minute))
+	if _, err := m.Authenticate("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Reload(); err == nil {
+		t.Fatal("Reload of invalid file succeeded")
+	}
+}
+
+func TestFileUserManagerLogin(t *testing.T) {
+	path := writeUserFile(t, tempDir(t), "users.json", fmt.Sprintf(
+		`{"users": [{"username": "alice", "password": %q, "permissions": "readonly"}]}`, bcryptHash(t, "secret")))
+	m, err := NewFileUserManager(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.DefaultHomeDir = "/srv/ftp"
+	fs := NewMemFileSystem()
+
+	_, addr := startTestServer(t, &FtpServerOpt{FtpUserManager: &fileSystemUserManager{m, fs}})
+	c := dialTestClient(t, addr)
+	c.cmd(reply331UserNameOkayNeedPassword, "USER alice")
+	c.cmd(reply530NotLoggedIn, "PASS wrong")
+	c.cmd(reply230UserLoggedIn, "PASS secret")
+	c.cmd(reply550RequestedActionNotTaken, "MKD new")
+}
+
+// 测试时把用户的文件系统换成内存文件系统
+type fileSystemUserManager struct {
+	FtpUserManager
+	fs FileSystem
+}
+
+func (m *fileSystemUserManager) Authenticate(username, password string) (*FtpUser, error) {
+	user, err := m.FtpUserManager.Authenticate(username, password)
+	if err == nil {
+		user.FileSystem = m.fs
+	}
+	return user, err
+}